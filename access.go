@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // the docker image has no timezone database
+)
+
+const (
+	minutesPerDay = 24 * 60
+
+	accessExpired       = "Access expired"
+	accessOutsideWindow = "Outside of access window"
+	accessInvalid       = "Invalid access schedule"
+
+	maxAccessChain = 15 // adjacent windows followed to find when access ends
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// AccessWindow - days and hours a user can access the PC, End before Start crosses midnight
+type AccessWindow struct {
+	Days  []string `json:"days,omitempty" bson:"days,omitempty"` // mon, tue... every day if empty
+	Start string   `json:"start" bson:"start"`                   // HH:MM
+	End   string   `json:"end" bson:"end"`                       // HH:MM, up to 24:00
+}
+
+/*
+UserAccess - when a user can access the PC
+
+Without windows the user can connect at any time, until ExpiresAt (if set).
+Window hours are in Timezone (UTC if empty)
+*/
+type UserAccess struct {
+	Timezone  string         `json:"timezone,omitempty" bson:"timezone,omitempty"`
+	Windows   []AccessWindow `json:"windows,omitempty" bson:"windows,omitempty"`
+	ExpiresAt *time.Time     `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+}
+
+// ParseUserAccess validates an access document, null removes every constraint
+func ParseUserAccess(value interface{}) (*UserAccess, []FieldError) {
+	if value == nil {
+		return nil, nil
+	}
+
+	var errs fieldErrors
+	data, ok := value.(Json)
+	if !ok {
+		errs.add("access", "must be an object")
+		return nil, errs
+	}
+	errs.unknownKeys("access.", data, "timezone", "windows", "expires_at")
+
+	access := &UserAccess{}
+
+	if value, found := data["timezone"]; found {
+		if access.Timezone, ok = value.(string); !ok {
+			errs.add("access.timezone", "must be a string")
+		} else if _, err := time.LoadLocation(access.Timezone); err != nil {
+			errs.add("access.timezone", "unknown timezone %q", access.Timezone)
+		}
+	}
+
+	if value, found := data["expires_at"]; found && value != nil {
+		expiresAt, ok := value.(string)
+		parsed, err := time.Parse(time.RFC3339, expiresAt)
+		if !ok || err != nil {
+			errs.add("access.expires_at", "must be a RFC 3339 date (2006-01-02T15:04:05Z)")
+		}
+		access.ExpiresAt = &parsed
+	}
+
+	if value, found := data["windows"]; found {
+		windows, ok := value.([]interface{})
+		if !ok {
+			errs.add("access.windows", "must be an array")
+		}
+
+		for i, value := range windows {
+			window, windowErrs := parseAccessWindow(fmt.Sprintf("access.windows[%d]", i), value)
+			errs = append(errs, windowErrs...)
+			access.Windows = append(access.Windows, window)
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return access, nil
+}
+
+func parseAccessWindow(field string, value interface{}) (AccessWindow, fieldErrors) {
+	var window AccessWindow
+	var errs fieldErrors
+
+	data, ok := value.(Json)
+	if !ok {
+		errs.add(field, "must be an object")
+		return window, errs
+	}
+	errs.unknownKeys(field+".", data, "days", "start", "end")
+
+	if value, found := data["days"]; found {
+		days, ok := value.([]interface{})
+		if !ok {
+			errs.add(field+".days", "must be an array")
+		}
+		for i, value := range days {
+			day, ok := value.(string)
+			if _, valid := weekdays[day]; !ok || !valid {
+				errs.add(fmt.Sprintf("%s.days[%d]", field, i), "must be one of sun, mon, tue, wed, thu, fri, sat")
+			}
+			window.Days = append(window.Days, day)
+		}
+	}
+
+	var start, end int
+	var startErr, endErr error
+	window.Start, _ = data["start"].(string)
+	if start, startErr = minuteOfDay(window.Start); startErr != nil {
+		errs.add(field+".start", "required, %s", startErr.Error())
+	}
+	window.End, _ = data["end"].(string)
+	if end, endErr = minuteOfDay(window.End); endErr != nil {
+		errs.add(field+".end", "required, %s", endErr.Error())
+	}
+
+	if startErr == nil && endErr == nil && (start == end || start == minutesPerDay) {
+		errs.add(field, "start and end must be different times")
+	}
+
+	return window, errs
+}
+
+// minuteOfDay parses HH:MM, 24:00 is the end of the day
+func minuteOfDay(value string) (int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) == 2 && len(parts[0]) == 2 && len(parts[1]) == 2 && isDigits(parts[0]) && isDigits(parts[1]) {
+		hours, hoursErr := strconv.Atoi(parts[0])
+		minutes, minutesErr := strconv.Atoi(parts[1])
+		minute := hours*60 + minutes
+		if hoursErr == nil && minutesErr == nil && minutes < 60 && minute <= minutesPerDay {
+			return minute, nil
+		}
+	}
+	return 0, fmt.Errorf("must be a time between 00:00 and 24:00")
+}
+
+// isDigits returns true if value only has ASCII digits, Atoi also takes signs
+func isDigits(value string) bool {
+	for _, char := range value {
+		if char < '0' || char > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (window AccessWindow) onDay(day time.Weekday) bool {
+	if len(window.Days) == 0 {
+		return true
+	}
+	for _, name := range window.Days {
+		if weekdays[name] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// endOf returns when the window containing now ends, false if now is outside of it
+func (window AccessWindow) endOf(now time.Time) (time.Time, bool) {
+	start, startErr := minuteOfDay(window.Start)
+	end, endErr := minuteOfDay(window.End)
+	if startErr != nil || endErr != nil {
+		return time.Time{}, false
+	}
+
+	minute := now.Hour()*60 + now.Minute()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	at := func(day time.Time, minute int) time.Time {
+		return time.Date(day.Year(), day.Month(), day.Day(), minute/60, minute%60, 0, 0, day.Location())
+	}
+
+	if start < end {
+		if window.onDay(now.Weekday()) && minute >= start && minute < end {
+			return at(midnight, end), true
+		}
+		return time.Time{}, false
+	}
+
+	// crosses midnight, the days are the ones it starts on
+	if window.onDay(now.Weekday()) && minute >= start {
+		return at(midnight.AddDate(0, 0, 1), end), true
+	}
+	if window.onDay(midnight.AddDate(0, 0, -1).Weekday()) && minute < end {
+		return at(midnight, end), true
+	}
+	return time.Time{}, false
+}
+
+func (access *UserAccess) location() (*time.Location, error) {
+	return time.LoadLocation(access.Timezone)
+}
+
+// windowEnd returns when the latest window containing now ends
+func (access *UserAccess) windowEnd(now time.Time) (time.Time, bool) {
+	var latest time.Time
+	found := false
+	for _, window := range access.Windows {
+		if end, ok := window.endOf(now); ok && (!found || end.After(latest)) {
+			latest, found = end, true
+		}
+	}
+	return latest, found
+}
+
+// check returns why the user can't access the PC at now, empty if it can
+func (access *UserAccess) check(now time.Time) string {
+	if access == nil {
+		return ""
+	}
+
+	if access.ExpiresAt != nil && !now.Before(*access.ExpiresAt) {
+		return accessExpired
+	}
+
+	if len(access.Windows) > 0 {
+		location, err := access.location()
+		if err != nil {
+			return accessInvalid
+		}
+		if _, ok := access.windowEnd(now.In(location)); !ok {
+			return accessOutsideWindow
+		}
+	}
+
+	return ""
+}
+
+/*
+endsAt returns when the access allowed at now ends, zero if it never does
+
+Adjacent windows (mon 18:00-24:00, tue 00:00-08:00) are followed up to maxAccessChain times,
+the access is checked again when the returned time comes
+*/
+func (access *UserAccess) endsAt(now time.Time) time.Time {
+	if access == nil {
+		return time.Time{}
+	}
+
+	var ends time.Time
+	if location, err := access.location(); err == nil && len(access.Windows) > 0 {
+		at := now.In(location)
+		for i := 0; i < maxAccessChain; i++ {
+			end, ok := access.windowEnd(at)
+			if !ok {
+				break
+			}
+			ends, at = end, end
+		}
+	}
+
+	if access.ExpiresAt != nil && (ends.IsZero() || access.ExpiresAt.Before(ends)) {
+		ends = *access.ExpiresAt
+	}
+	return ends
+}
+
+// copy returns a copy that shares nothing with access
+func (access *UserAccess) copy() *UserAccess {
+	if access == nil {
+		return nil
+	}
+
+	accessCopy := *access
+	if access.ExpiresAt != nil {
+		expiresAt := *access.ExpiresAt
+		accessCopy.ExpiresAt = &expiresAt
+	}
+
+	accessCopy.Windows = make([]AccessWindow, len(access.Windows))
+	for i, window := range access.Windows {
+		accessCopy.Windows[i] = window
+		accessCopy.Windows[i].Days = append([]string(nil), window.Days...)
+	}
+	return &accessCopy
+}
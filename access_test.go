@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUserAccess(t *testing.T) {
+	access, errs := ParseUserAccess(Json{
+		"timezone":   "America/Sao_Paulo",
+		"windows":    []interface{}{Json{"days": []interface{}{"mon", "fri"}, "start": "22:00", "end": "06:00"}},
+		"expires_at": "2030-01-01T00:00:00Z",
+	})
+	assert.Nil(t, errs)
+	assert.Equal(t, []AccessWindow{{Days: []string{"mon", "fri"}, Start: "22:00", End: "06:00"}}, access.Windows)
+	assert.Equal(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), *access.ExpiresAt)
+
+	access, errs = ParseUserAccess(nil)
+	assert.Nil(t, access)
+	assert.Nil(t, errs)
+
+	_, errs = ParseUserAccess(Json{
+		"timezone":   "Mars/Olympus",
+		"windows":    []interface{}{Json{"days": []interface{}{"monday"}, "start": "8:00", "end": "24:01"}, Json{"start": "10:00", "end": "10:00"}, Json{"start": "-1:30", "end": "00:-5"}},
+		"expires_at": "tomorrow",
+		"max":        1,
+	})
+	fields := make([]string, len(errs))
+	for i, err := range errs {
+		fields[i] = err.Field
+	}
+	assert.Equal(t, []string{
+		"access.max",
+		"access.timezone",
+		"access.expires_at",
+		"access.windows[0].days[0]",
+		"access.windows[0].start",
+		"access.windows[0].end",
+		"access.windows[1]",
+		"access.windows[2].start",
+		"access.windows[2].end",
+	}, fields)
+}
+
+func TestUserAccessCheck(t *testing.T) {
+	location, err := time.LoadLocation("America/Sao_Paulo")
+	assert.Nil(t, err)
+	// 2020-01-06 is a monday
+	at := func(day, hour, minute int) time.Time { return time.Date(2020, 1, day, hour, minute, 0, 0, location) }
+	expired := at(6, 12, 0)
+
+	business := &UserAccess{Timezone: "America/Sao_Paulo", Windows: []AccessWindow{
+		{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "08:00", End: "18:00"},
+	}}
+	overnight := &UserAccess{Timezone: "America/Sao_Paulo", Windows: []AccessWindow{
+		{Days: []string{"fri"}, Start: "22:00", End: "06:00"},
+	}}
+
+	tests := []struct {
+		access *UserAccess
+		now    time.Time
+		reason string
+	}{
+		{nil, at(6, 3, 0), ""},
+		{business, at(6, 8, 0), ""},
+		{business, at(6, 17, 59), ""},
+		{business, at(6, 18, 0), accessOutsideWindow},
+		{business, at(6, 7, 59), accessOutsideWindow},
+		{business, at(5, 12, 0), accessOutsideWindow}, // sunday
+		{business, at(6, 12, 0).UTC(), ""},            // converted to the access timezone
+		{overnight, at(10, 23, 0), ""},
+		{overnight, at(11, 5, 59), ""}, // saturday, but the window started on friday
+		{overnight, at(11, 6, 0), accessOutsideWindow},
+		{overnight, at(11, 23, 0), accessOutsideWindow},
+		{&UserAccess{ExpiresAt: &expired}, at(6, 11, 59), ""},
+		{&UserAccess{ExpiresAt: &expired}, at(6, 12, 0), accessExpired},
+		{&UserAccess{Timezone: "Mars/Olympus", Windows: business.Windows}, at(6, 12, 0), accessInvalid},
+	}
+
+	for i, test := range tests {
+		assert.Equal(t, test.reason, test.access.check(test.now), "test %d", i)
+	}
+}
+
+func TestUserAccessEndsAt(t *testing.T) {
+	at := func(day, hour, minute int) time.Time { return time.Date(2020, 1, day, hour, minute, 0, 0, time.UTC) }
+	expiresAt := at(6, 12, 0)
+
+	access := &UserAccess{Windows: []AccessWindow{
+		{Days: []string{"mon"}, Start: "18:00", End: "24:00"},
+		{Days: []string{"tue"}, Start: "00:00", End: "08:00"},
+		{Days: []string{"tue"}, Start: "07:00", End: "09:00"},
+	}}
+
+	assert.True(t, (*UserAccess)(nil).endsAt(at(6, 12, 0)).IsZero())
+	assert.True(t, (&UserAccess{}).endsAt(at(6, 12, 0)).IsZero())
+	assert.Equal(t, expiresAt, (&UserAccess{ExpiresAt: &expiresAt}).endsAt(at(6, 10, 0)))
+
+	// adjacent and overlapping windows are followed
+	assert.True(t, at(7, 9, 0).Equal(access.endsAt(at(6, 20, 0))))
+	assert.True(t, at(7, 9, 0).Equal(access.endsAt(at(7, 7, 30))))
+
+	access.ExpiresAt = &expiresAt
+	access.Windows = []AccessWindow{{Start: "10:00", End: "14:00"}}
+	assert.Equal(t, expiresAt, access.endsAt(at(6, 11, 0)))
+}
+
+func TestAccessEnforcement(t *testing.T) {
+	store := NewMemoryStore()
+	if err := setup(store); err != nil {
+		panic(err.Error())
+	}
+
+	wsController := NewWsController("admin", "admin", store, "")
+	server := httptest.NewServer(wsController.routes())
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	authHeader := http.Header{"X-Username": []string{"username"}, "X-Password": []string{"passwd"}}
+	adminHeader := http.Header{
+		"X-Username": []string{fmt.Sprintf("%x", sha256.Sum256([]byte("admin")))},
+		"X-Password": []string{fmt.Sprintf("%x", sha256.Sum256([]byte("admin")))},
+	}
+
+	wsPcConn, _, err := dialPC(wsURL+"/connect/"+key, authHeader, nil)
+	assert.Nil(t, err)
+	defer wsPcConn.Close()
+
+	resp, body := postJson(t, server.URL+"/set_user_access/"+key, adminHeader, Json{
+		"username": "username",
+		"access":   Json{"windows": []interface{}{Json{"start": "25:00", "end": "08:00"}}},
+	})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "Invalid access", body["error"])
+
+	expiresAt := time.Now().Add(3 * time.Second).Format(time.RFC3339Nano)
+	resp, _ = postJson(t, server.URL+"/set_user_access/"+key, adminHeader, Json{
+		"username": "username",
+		"access":   Json{"expires_at": expiresAt},
+	})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the session is closed when the access expires
+	userConn, _, err := dialUser(wsURL+"/access/"+key, authHeader)
+	assert.Nil(t, err)
+	defer userConn.Close()
+
+	userConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for err == nil {
+		_, _, err = userConn.ReadMessage()
+	}
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), err.Error())
+	assert.Contains(t, err.Error(), accessExpired)
+
+	// and the user can't connect again
+	_, response, err := dialUser(wsURL+"/access/"+key, authHeader)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+
+	// null removes the constraints
+	resp, _ = postJson(t, server.URL+"/set_user_access/"+key, adminHeader, Json{"username": "username", "access": nil})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	userConn, _, err = dialUser(wsURL+"/access/"+key, authHeader)
+	assert.Nil(t, err)
+	defer userConn.Close()
+
+	// changes apply to the sessions already connected
+	resp, _ = postJson(t, server.URL+"/set_user_access/"+key, adminHeader, Json{
+		"username": "username",
+		"access":   Json{"expires_at": time.Now().Add(time.Hour).Format(time.RFC3339Nano)},
+	})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assertUserCount(t, wsController.remotePcs.get(key), 1)
+
+	resp, _ = postJson(t, server.URL+"/set_user_access/"+key, adminHeader, Json{
+		"username": "username",
+		"access":   Json{"expires_at": time.Now().Format(time.RFC3339Nano)},
+	})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	userConn.SetReadDeadline(time.Now().Add(time.Second))
+	for err == nil {
+		_, _, err = userConn.ReadMessage()
+	}
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), err.Error())
+	assert.Contains(t, err.Error(), accessExpired)
+}
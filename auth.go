@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isAdmin checks the admin credentials sent by a client
+func (wsController *WsController) isAdmin(username, password string) bool {
+	validUsername := subtle.ConstantTimeCompare([]byte(username), []byte(wsController.adminUsername)) == 1
+	validPassword := subtle.ConstantTimeCompare([]byte(password), []byte(wsController.adminPassword)) == 1
+	return validUsername && validPassword
+}
+
+// currentStamp returns the stamp that tokens issued now for these claims would have
+func (wsController *WsController) currentStamp(claims *TokenClaims) (string, error) {
+	switch claims.Role {
+	case RoleAdmin:
+		if claims.Username != wsController.adminUsername {
+			return "", ErrInvalidToken
+		}
+		return wsController.tokens.stamp(wsController.adminPassword), nil
+
+	case RolePC:
+		pc, err := wsController.store.FindPC(claims.PcKey)
+		if err != nil {
+			return "", err
+		}
+		if pc.Username != claims.Username {
+			return "", ErrInvalidToken
+		}
+		return wsController.tokens.stamp(pc.Password), nil
+
+	case RoleUser:
+		user, err := wsController.store.FindUser(claims.Username, claims.PcKey)
+		if err != nil {
+			return "", err
+		}
+		return wsController.tokens.stamp(user.Password), nil
+	}
+
+	return "", ErrInvalidToken
+}
+
+/*
+parseToken returns the claims of a token that wasn't revoked
+
+A token is revoked when the password it was issued for changes
+or the account is removed
+*/
+func (wsController *WsController) parseToken(token, tokenType string) (*TokenClaims, error) {
+	claims, err := wsController.tokens.Parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Type != tokenType {
+		return nil, ErrInvalidToken
+	}
+
+	stamp, err := wsController.currentStamp(claims)
+	if err != nil || subtle.ConstantTimeCompare([]byte(stamp), []byte(claims.Stamp)) != 1 {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// checkToken returns the claims of an access token, only if it grants role on the PC
+func (wsController *WsController) checkToken(token, role, pcKey string) (*TokenClaims, bool) {
+	claims, err := wsController.parseToken(token, AccessToken)
+	if err != nil {
+		log.Printf("Invalid %s token. Error: %s\n", role, err.Error())
+		return nil, false
+	}
+
+	if claims.Role != role {
+		return nil, false
+	}
+
+	if claims.PcKey != pcKey && !(role == RoleAdmin && len(claims.PcKey) == 0) {
+		return nil, false
+	}
+
+	return claims, true
+}
+
+// issueTokens returns a new access and refresh token pair for the claims
+func (wsController *WsController) issueTokens(claims TokenClaims) (Json, error) {
+	stamp, err := wsController.currentStamp(&claims)
+	if err != nil {
+		return nil, err
+	}
+	claims.Stamp = stamp
+
+	claims.Type = AccessToken
+	accessToken, err := wsController.tokens.Issue(claims, accessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	claims.Type = RefreshToken
+	refreshToken, err := wsController.tokens.Issue(claims, refreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return Json{
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+		"token_type":    tokenSubprotocol,
+		"expires_in":    int(accessTokenTTL / time.Second),
+	}, nil
+}
+
+/*
+Handles a login
+
+Verifies the credentials of an admin, PC or user once
+and returns the tokens to be used instead of them
+*/
+func (wsController *WsController) login() http.HandlerFunc {
+	return func(response http.ResponseWriter, req *http.Request) {
+		loginData, err := requestBodyToJson(req.Body)
+		if err != nil {
+			log.Printf("Failed to parse login data -- %s\n", err.Error())
+			httpBadRequest(response)
+			return
+		}
+
+		role, _ := loginData["role"].(string)
+		username, _ := loginData["username"].(string)
+		password, _ := loginData["password"].(string)
+		pcKey, _ := loginData["key"].(string)
+		pcKey = strings.TrimSpace(pcKey)
+
+		if len(username) == 0 || len(password) == 0 || (role != RoleAdmin && len(pcKey) == 0) {
+			httpError(response, NewRegisterError(http.StatusBadRequest, "invalid request"))
+			return
+		}
+
+		valid := false
+		switch role {
+		case RoleAdmin:
+			valid = wsController.isAdmin(username, password)
+		case RolePC:
+			valid = AuthenticatePC(username, password, pcKey, wsController.store)
+		case RoleUser:
+			valid = AuthenticateUser(username, password, pcKey, wsController.store) != nil
+		default:
+			httpError(response, NewRegisterError(http.StatusBadRequest, "invalid role"))
+			return
+		}
+
+		if !valid {
+			log.Printf("Failed %s login of '%s'\n", role, username)
+			httpError(response, NewRegisterError(http.StatusUnauthorized, "invalid credentials"))
+			return
+		}
+
+		tokens, err := wsController.issueTokens(TokenClaims{Username: username, PcKey: pcKey, Role: role})
+		if err != nil {
+			log.Printf("Failed to issue tokens. Error: %s\n", err.Error())
+			response.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJson(response, http.StatusOK, tokens)
+	}
+}
+
+// Handles a refresh token, returning a new token pair
+func (wsController *WsController) refresh() http.HandlerFunc {
+	return func(response http.ResponseWriter, req *http.Request) {
+		jsonData, err := requestBodyToJson(req.Body)
+		if err != nil {
+			httpBadRequest(response)
+			return
+		}
+
+		refreshToken, _ := jsonData["refresh_token"].(string)
+
+		claims, err := wsController.parseToken(refreshToken, RefreshToken)
+		if err != nil {
+			log.Printf("Invalid refresh token. Error: %s\n", err.Error())
+			httpError(response, NewRegisterError(http.StatusUnauthorized, "invalid refresh token"))
+			return
+		}
+
+		tokens, err := wsController.issueTokens(*claims)
+		if err != nil {
+			log.Printf("Failed to issue tokens. Error: %s\n", err.Error())
+			response.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJson(response, http.StatusOK, tokens)
+	}
+}
+
+// authenticateUserRequest returns the user record for the token or x-username/x-password headers
+func (wsController *WsController) authenticateUserRequest(req *http.Request, pcKey string) *UserRecord {
+	if token := getAuthToken(req); len(token) > 0 {
+		claims, ok := wsController.checkToken(token, RoleUser, pcKey)
+		if !ok {
+			return nil
+		}
+
+		user, err := wsController.store.FindUser(claims.Username, pcKey)
+		if err != nil {
+			return nil
+		}
+		return user
+	}
+
+	username, password := getAuthHeaders(req)
+	return AuthenticateUser(username, password, pcKey, wsController.store)
+}
+
+// hasCredentials checks if the request has a token or x-username/x-password headers
+func hasCredentials(req *http.Request) bool {
+	username, password := getAuthHeaders(req)
+	return len(getAuthToken(req)) > 0 || (len(username) > 0 && len(password) > 0)
+}
+
+func writeJson(response http.ResponseWriter, status int, data interface{}) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	response.Write(jsonData)
+}
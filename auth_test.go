@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func postJson(t *testing.T, url string, header http.Header, data Json) (*http.Response, Json) {
+	body, err := json.Marshal(data)
+	assert.Nil(t, err)
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	assert.Nil(t, err)
+	if header != nil {
+		req.Header = header
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	jsonResponse := make(Json)
+	json.NewDecoder(resp.Body).Decode(&jsonResponse)
+	return resp, jsonResponse
+}
+
+func TestSuiteLogin(t *testing.T) {
+	var (
+		adminUser     = fmt.Sprintf("%x", sha256.Sum256([]byte("admin")))
+		adminPassword = fmt.Sprintf("%x", sha256.Sum256([]byte("admin")))
+	)
+
+	store := NewMemoryStore()
+	if err := setup(store); err != nil {
+		panic(err.Error())
+	}
+
+	wsController := NewWsController("admin", "admin", store, "secret")
+	server := httptest.NewServer(wsController.routes())
+	defer server.Close()
+
+	login := func(role, username, password string) (*http.Response, Json) {
+		return postJson(t, server.URL+"/login", nil, Json{"role": role, "username": username, "password": password, "key": key})
+	}
+	bearer := func(token string) http.Header {
+		return http.Header{"Authorization": []string{"Bearer " + token}}
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// the PC stays connected for every test after it connects
+	var wsPcConn *websocket.Conn
+	defer func() {
+		if wsPcConn != nil {
+			wsPcConn.Close()
+		}
+	}()
+
+	t.Run("InvalidCredentials", func(t *testing.T) {
+		resp, _ := login(RoleUser, "username", "wrong")
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp, _ = login("superuser", "username", "passwd")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("PcAndUserConnectWithTokens", func(t *testing.T) {
+		resp, pcTokens := login(RolePC, "username", "passwd")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var response *http.Response
+		var err error
+		wsPcConn, response, err = dialPC(wsURL+"/connect/"+key, bearer(pcTokens["access_token"].(string)), nil)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+
+		resp, userTokens := login(RoleUser, "username", "passwd")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		dialer := websocket.Dialer{Subprotocols: []string{tokenSubprotocol, userTokens["access_token"].(string)}}
+		ws, response, err := dialer.Dial(wsURL+"/access/"+key, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+		assert.Equal(t, tokenSubprotocol, ws.Subprotocol())
+		ws.Close()
+		time.Sleep(time.Millisecond * 100)
+
+		// a user token can't be used by the PC
+		_, response, err = websocket.DefaultDialer.Dial(wsURL+"/connect/"+key, bearer(userTokens["access_token"].(string)))
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusForbidden, response.StatusCode)
+	})
+
+	t.Run("AdminToken", func(t *testing.T) {
+		resp, adminTokens := postJson(t, server.URL+"/login", nil, Json{"role": RoleAdmin, "username": adminUser, "password": adminPassword})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp, _ = postJson(t, server.URL+"/create_user/"+key, bearer(adminTokens["access_token"].(string)), Json{"username": "other", "password": "passwd"})
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		// refresh tokens are not access tokens
+		resp, _ = postJson(t, server.URL+"/create_user/"+key, bearer(adminTokens["refresh_token"].(string)), Json{"username": "another", "password": "passwd"})
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+		// a token for one PC can't create another one, by URL or by body
+		resp, pcTokens := postJson(t, server.URL+"/login", nil, Json{"role": RoleAdmin, "username": adminUser, "password": adminPassword, "key": key})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		pcAdmin := bearer(pcTokens["access_token"].(string))
+		newPc := Json{"username": "username", "password": "passwd", "key": "another-pc"}
+
+		resp, _ = postJson(t, server.URL+"/create_pc/another-pc", pcAdmin, newPc)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		resp, _ = postJson(t, server.URL+"/create_pc/"+key, pcAdmin, newPc)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		_, err := store.FindPC("another-pc")
+		assert.Equal(t, ErrNotFound, err)
+	})
+
+	t.Run("Refresh", func(t *testing.T) {
+		_, userTokens := login(RoleUser, "username", "passwd")
+
+		resp, newTokens := postJson(t, server.URL+"/refresh", nil, Json{"refresh_token": userTokens["refresh_token"]})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NotEmpty(t, newTokens["access_token"])
+
+		resp, _ = postJson(t, server.URL+"/refresh", nil, Json{"refresh_token": userTokens["access_token"]})
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("RevokedOnPasswordChange", func(t *testing.T) {
+		adminHeader := http.Header{"X-Username": []string{adminUser}, "X-Password": []string{adminPassword}}
+		_, userTokens := login(RoleUser, "other", "passwd")
+		session, _, err := dialUser(wsURL+"/access/"+key, http.Header{"X-Username": []string{"other"}, "X-Password": []string{"passwd"}})
+		assert.Nil(t, err)
+		defer session.Close()
+
+		resp, _ := postJson(t, server.URL+"/set_user_password/"+key, adminHeader, Json{"username": "other", "password": "new passwd"})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// open sessions are closed too
+		_, _, err = session.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+
+		_, response, err := websocket.DefaultDialer.Dial(wsURL+"/access/"+key, bearer(userTokens["access_token"].(string)))
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+		resp, _ = postJson(t, server.URL+"/refresh", nil, Json{"refresh_token": userTokens["refresh_token"]})
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("RevokedOnRemoval", func(t *testing.T) {
+		adminHeader := http.Header{"X-Username": []string{adminUser}, "X-Password": []string{adminPassword}}
+		_, userTokens := login(RoleUser, "other", "new passwd")
+		session, _, err := dialUser(wsURL+"/access/"+key, http.Header{"X-Username": []string{"other"}, "X-Password": []string{"new passwd"}})
+		assert.Nil(t, err)
+		defer session.Close()
+
+		resp, _ := postJson(t, server.URL+"/remove_user/"+key, adminHeader, Json{"username": "other"})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		_, _, err = session.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+
+		resp, _ = postJson(t, server.URL+"/refresh", nil, Json{"refresh_token": userTokens["refresh_token"]})
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
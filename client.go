@@ -1,25 +1,176 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
 
+const closeGracePeriod = 5 * time.Second // how long the peer has to answer a close message
+
+// maxCloseReason - control frames carry up to 125 bytes, 2 of them are the close code
+const maxCloseReason = 123
+
+// set from the configuration, see Config.apply
+var (
+	outboundQueueSize       = 256
+	writeWait               = 10 * time.Second
+	maxMessageSize    int64 = 0 // bytes read from a connection in a single message, 0 for no limit
+)
+
+// SlowConsumerPolicy - what happens when a connection's outbound queue is full
+type SlowConsumerPolicy int
+
+const (
+	BlockWriter SlowConsumerPolicy = iota // wait until there is room in the queue
+	DropMessage                           // drop the message, the connection stays open
+	Disconnect                            // close the connection with CloseTryAgainLater
+)
+
+var (
+	errQueueFull  = errors.New("outbound queue full")
+	errConnClosed = errors.New("connection closed")
+)
+
+type outboundMessage struct {
+	msgType int
+	data    []byte
+}
+
+/*
+connWriter - the only goroutine that writes to a websocket connection
+
+gorilla/websocket doesn't allow concurrent writers, every message
+(relayed data, error replies, close messages) goes through its queue
+*/
+type connWriter struct {
+	conn   *websocket.Conn
+	policy SlowConsumerPolicy
+	queue  chan outboundMessage
+
+	done      chan struct{} // closed when the writer stops
+	stopOnce  sync.Once
+	closeOnce sync.Once
+}
+
+func newConnWriter(conn *websocket.Conn, policy SlowConsumerPolicy, queueSize int) *connWriter {
+	writer := &connWriter{
+		conn:   conn,
+		policy: policy,
+		queue:  make(chan outboundMessage, queueSize),
+		done:   make(chan struct{}),
+	}
+	go writer.writeRoutine()
+	return writer
+}
+
+func (writer *connWriter) writeRoutine() {
+	defer writer.stop()
+
+	for {
+		select {
+		case msg := <-writer.queue:
+			writer.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := writer.conn.WriteMessage(msg.msgType, msg.data); err != nil {
+				writer.conn.Close()
+				return
+			}
+
+			if msg.msgType == websocket.CloseMessage {
+				time.AfterFunc(closeGracePeriod, func() { writer.conn.Close() })
+				return
+			}
+		case <-writer.done:
+			return
+		}
+	}
+}
+
+// write queues a message, applying the slow consumer policy if the queue is full
+func (writer *connWriter) write(msgType int, data []byte) error {
+	msg := outboundMessage{msgType, data}
+
+	select {
+	case <-writer.done:
+		return errConnClosed
+	case writer.queue <- msg:
+		return nil
+	default:
+	}
+
+	switch writer.policy {
+	case BlockWriter:
+		select {
+		case writer.queue <- msg:
+			return nil
+		case <-writer.done:
+			return errConnClosed
+		}
+	case Disconnect:
+		closeMsg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "slow consumer")
+		writer.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+		writer.conn.Close()
+		writer.stop()
+	}
+
+	return errQueueFull
+}
+
+// close sends a close message after every queued message, then stops the writer
+func (writer *connWriter) close(code int, reason string) {
+	writer.closeOnce.Do(func() {
+		closeMsg := websocket.FormatCloseMessage(code, truncateReason(reason))
+
+		select {
+		case writer.queue <- outboundMessage{websocket.CloseMessage, closeMsg}:
+		default:
+			// no room for it, close right away
+			writer.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+			writer.conn.Close()
+			writer.stop()
+		}
+	})
+}
+
+// truncateReason cuts the reason to maxCloseReason bytes, without splitting a character
+func truncateReason(reason string) string {
+	if len(reason) <= maxCloseReason {
+		return reason
+	}
+	end := maxCloseReason
+	for end > 0 && !utf8.RuneStart(reason[end]) {
+		end--
+	}
+	return reason[:end]
+}
+
+// stop stops the writer, queued messages are discarded
+func (writer *connWriter) stop() {
+	writer.stopOnce.Do(func() { close(writer.done) })
+}
+
 type Client interface {
-	getConn() *websocket.Conn
+	getWriter() *connWriter
 }
 
 func ClientWriteText(client Client, data []byte) error {
-	return client.getConn().WriteMessage(websocket.TextMessage, data)
+	return ClientWrite(client, websocket.TextMessage, data)
 }
 func ClientWriteJSON(client Client, data interface{}) error {
-	return client.getConn().WriteJSON(data)
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return ClientWrite(client, websocket.TextMessage, jsonData)
 }
 
 func ClientWrite(client Client, msgType int, data []byte) error {
-	if client != nil && client.getConn() != nil {
-		return client.getConn().WriteMessage(msgType, data)
+	if client != nil && client.getWriter() != nil {
+		return client.getWriter().write(msgType, data)
 	}
 	return errors.New("Invalid client")
 }
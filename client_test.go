@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// wsPair returns both ends of a websocket connection
+func wsPair(t *testing.T) (serverConn *websocket.Conn, clientConn *websocket.Conn, closeAll func()) {
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(response, req, nil)
+		assert.Nil(t, err)
+		conns <- conn
+	}))
+
+	clientConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.Nil(t, err)
+	serverConn = <-conns
+
+	return serverConn, clientConn, func() {
+		clientConn.Close()
+		serverConn.Close()
+		server.Close()
+	}
+}
+
+type testClient struct {
+	writer *connWriter
+}
+
+func (client *testClient) getWriter() *connWriter {
+	return client.writer
+}
+
+// run with -race
+func TestConcurrentWrites(t *testing.T) {
+	serverConn, clientConn, closeAll := wsPair(t)
+	defer closeAll()
+
+	client := &testClient{newConnWriter(serverConn, BlockWriter, 4)}
+
+	const writers, messages = 10, 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				assert.Nil(t, ClientWriteJSON(client, Json{"writer": i, "msg": j}))
+			}
+		}(i)
+	}
+
+	received := make(map[string]bool)
+	for len(received) < writers*messages {
+		msg := make(Json)
+		assert.Nil(t, clientConn.ReadJSON(&msg))
+		received[fmt.Sprintf("%v-%v", msg["writer"], msg["msg"])] = true
+	}
+	wg.Wait()
+
+	client.writer.close(websocket.CloseNormalClosure, "bye")
+	_, _, err := clientConn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+}
+
+func TestSlowConsumerPolicy(t *testing.T) {
+	// writers without a writeRoutine, so the queue is never emptied
+	stalledWriter := func(conn *websocket.Conn, policy SlowConsumerPolicy) *connWriter {
+		return &connWriter{conn: conn, policy: policy, queue: make(chan outboundMessage, 1), done: make(chan struct{})}
+	}
+
+	t.Run("DropMessage", func(t *testing.T) {
+		serverConn, _, closeAll := wsPair(t)
+		defer closeAll()
+
+		writer := stalledWriter(serverConn, DropMessage)
+		assert.Nil(t, writer.write(websocket.TextMessage, []byte("first")))
+		assert.Equal(t, errQueueFull, writer.write(websocket.TextMessage, []byte("second")))
+		assert.Equal(t, errQueueFull, writer.write(websocket.TextMessage, []byte("third")))
+
+		select {
+		case <-writer.done:
+			t.Error("the connection must stay open")
+		default:
+		}
+	})
+
+	t.Run("Disconnect", func(t *testing.T) {
+		serverConn, clientConn, closeAll := wsPair(t)
+		defer closeAll()
+
+		writer := stalledWriter(serverConn, Disconnect)
+		assert.Nil(t, writer.write(websocket.TextMessage, []byte("first")))
+		assert.Equal(t, errQueueFull, writer.write(websocket.TextMessage, []byte("second")))
+		assert.Equal(t, errConnClosed, writer.write(websocket.TextMessage, []byte("third")))
+
+		_, _, err := clientConn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseTryAgainLater))
+	})
+
+	t.Run("BlockWriter", func(t *testing.T) {
+		serverConn, _, closeAll := wsPair(t)
+		defer closeAll()
+
+		writer := stalledWriter(serverConn, BlockWriter)
+		assert.Nil(t, writer.write(websocket.TextMessage, []byte("first")))
+
+		result := make(chan error)
+		go func() { result <- writer.write(websocket.TextMessage, []byte("second")) }()
+
+		<-writer.queue // room for the blocked message
+		assert.Nil(t, <-result)
+
+		go func() { result <- writer.write(websocket.TextMessage, []byte("third")) }()
+		writer.stop()
+		assert.Equal(t, errConnClosed, <-result)
+	})
+}
+
+func TestTruncateReason(t *testing.T) {
+	assert.Equal(t, "short", truncateReason("short"))
+	assert.Len(t, truncateReason(strings.Repeat("a", 200)), maxCloseReason)
+
+	reason := truncateReason(strings.Repeat("é", 100))
+	assert.Len(t, reason, maxCloseReason-1)
+	assert.True(t, utf8.ValidString(reason))
+}
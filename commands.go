@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// argKind - the type of a command argument
+type argKind string
+
+const (
+	pathArg    argKind = "path" // canonicalized and checked against the restrictions
+	integerArg argKind = "integer"
+	boolArg    argKind = "bool"
+	enumArg    argKind = "enum" // a string, one of the values
+)
+
+// argSpec - an argument of a command, optional arguments can only be at the end
+type argSpec struct {
+	Name     string   `json:"name"`
+	Kind     argKind  `json:"kind"`
+	Values   []string `json:"values,omitempty"`
+	Optional bool     `json:"optional,omitempty"`
+}
+
+/*
+commandSpec - a command the server knows, the arguments a user sends are validated against it
+
+Listing commands act on the directory passed as argument, restrictions with allow
+apply to it and allow_subdir to what is inside. Other commands act on a file, allow
+also applies to the files directly in the restricted directory
+*/
+type commandSpec struct {
+	Name    string    `json:"name"`
+	Args    []argSpec `json:"args"`
+	Listing bool      `json:"listing,omitempty"`
+}
+
+/*
+commandRegistry - the commands the server knows
+
+Commands that are not listed are sent to the PC with their args as they are,
+they are denied unless a rule allows them
+*/
+var commandRegistry = newCommandRegistry(
+	commandSpec{Name: "ls_dir", Args: []argSpec{{Name: "path", Kind: pathArg}}, Listing: true},
+	commandSpec{Name: "download_file", Args: []argSpec{{Name: "path", Kind: pathArg}}},
+	commandSpec{Name: "upload_file", Args: []argSpec{{Name: "path", Kind: pathArg}, {Name: "overwrite", Kind: boolArg, Optional: true}}},
+	commandSpec{Name: "delete_file", Args: []argSpec{{Name: "path", Kind: pathArg}}},
+	commandSpec{Name: "rename_file", Args: []argSpec{{Name: "path", Kind: pathArg}, {Name: "new_path", Kind: pathArg}}},
+	commandSpec{Name: "copy_file", Args: []argSpec{{Name: "path", Kind: pathArg}, {Name: "new_path", Kind: pathArg}}},
+	commandSpec{Name: "create_dir", Args: []argSpec{{Name: "path", Kind: pathArg}}},
+	commandSpec{Name: "kill_process", Args: []argSpec{{Name: "pid", Kind: integerArg}}},
+	commandSpec{Name: "power", Args: []argSpec{{Name: "action", Kind: enumArg, Values: []string{"shutdown", "restart", "sleep"}}}},
+)
+
+func newCommandRegistry(specs ...commandSpec) map[string]commandSpec {
+	registry := make(map[string]commandSpec, len(specs))
+	for _, spec := range specs {
+		registry[spec.Name] = spec
+	}
+	return registry
+}
+
+// lookupCommand returns the spec of cmd, false if the server doesn't know it
+func lookupCommand(cmd string) (commandSpec, bool) {
+	spec, found := commandRegistry[cmd]
+	return spec, found
+}
+
+// isListingCommand returns true if cmd acts on the directory passed as argument, see commandSpec
+func isListingCommand(cmd string) bool {
+	spec, _ := lookupCommand(cmd)
+	return spec.Listing
+}
+
+// hasPathArgs returns true if some argument of the command is a path, the ones restrictions apply to
+func (spec commandSpec) hasPathArgs() bool {
+	for _, arg := range spec.Args {
+		if arg.Kind == pathArg {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the number and the types of the args
+func (spec commandSpec) validate(args []interface{}) error {
+	required := 0
+	for _, arg := range spec.Args {
+		if !arg.Optional {
+			required++
+		}
+	}
+
+	if len(args) < required || len(args) > len(spec.Args) {
+		if required == len(spec.Args) {
+			return fmt.Errorf("wrong number of arguments, expected %d, got %d", required, len(args))
+		}
+		return fmt.Errorf("wrong number of arguments, expected %d to %d, got %d", required, len(spec.Args), len(args))
+	}
+
+	for i, value := range args {
+		if err := spec.Args[i].validate(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (arg argSpec) validate(value interface{}) error {
+	switch arg.Kind {
+	case pathArg:
+		if _, ok := value.(string); !ok {
+			return errPathType
+		}
+	case integerArg:
+		if number, ok := value.(float64); !ok || number != math.Trunc(number) {
+			return fmt.Errorf("%s must be an integer", arg.Name)
+		}
+	case boolArg:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", arg.Name)
+		}
+	case enumArg:
+		value, _ := value.(string)
+		for _, allowed := range arg.Values {
+			if value == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s must be one of %s", arg.Name, strings.Join(arg.Values, ", "))
+	}
+	return nil
+}
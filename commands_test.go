@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandValidation(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []interface{}
+		err  string
+	}{
+		{"ls_dir", []interface{}{"/home"}, ""},
+		{"upload_file", []interface{}{"/home/file"}, ""},
+		{"upload_file", []interface{}{"/home/file", true}, ""},
+		{"kill_process", []interface{}{float64(1234)}, ""},
+		{"power", []interface{}{"restart"}, ""},
+		{"sync_files", []interface{}{"/a", float64(1), true}, ""}, // not registered
+
+		{"ls_dir", []interface{}{}, "wrong number of arguments, expected 1, got 0"},
+		{"ls_dir", []interface{}{"/home", "/tmp"}, "wrong number of arguments, expected 1, got 2"},
+		{"upload_file", []interface{}{"/home/file", true, true}, "wrong number of arguments, expected 1 to 2, got 3"},
+		{"upload_file", []interface{}{"/home/file", "yes"}, "overwrite must be a boolean"},
+		{"rename_file", []interface{}{"/home/file", float64(1)}, "path must be a string"},
+		{"kill_process", []interface{}{"1234"}, "pid must be an integer"},
+		{"kill_process", []interface{}{1.5}, "pid must be an integer"},
+		{"power", []interface{}{"format"}, "action must be one of shutdown, restart, sleep"},
+		{"power", []interface{}{true}, "action must be one of shutdown, restart, sleep"},
+	}
+
+	for _, test := range tests {
+		_, err := canonicalArgs(posixPaths, test.cmd, test.args)
+		if len(test.err) == 0 {
+			assert.Nil(t, err, "%s %v", test.cmd, test.args)
+			continue
+		}
+		if assert.NotNil(t, err, "%s %v", test.cmd, test.args) {
+			assert.Equal(t, test.err, err.Error(), "%s %v", test.cmd, test.args)
+		}
+	}
+
+	assert.True(t, isListingCommand("ls_dir"))
+	assert.False(t, isListingCommand("download_file"))
+	assert.False(t, isListingCommand("sync_files"))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/cel-go/cel"
+)
+
+const (
+	maxConditionLength = 1024
+	maxConditionCost   = 10000 // evaluation steps, see cel.CostLimit
+)
+
+/*
+conditionEnv - what a condition can use, written in CEL (https://github.com/google/cel-spec)
+
+	cmd       command name
+	args      command arguments
+	username  user running the command
+	pc_key    key of the PC
+	now       when the command was received (timestamp)
+
+Conditions can't call anything but the CEL built-in functions, so they can't have
+side effects, and their evaluation is stopped after maxConditionCost steps
+*/
+var conditionEnv = newConditionEnv()
+
+func newConditionEnv() *cel.Env {
+	env, err := cel.NewEnv(
+		cel.Variable("cmd", cel.StringType),
+		cel.Variable("args", cel.ListType(cel.DynType)),
+		cel.Variable("username", cel.StringType),
+		cel.Variable("pc_key", cel.StringType),
+		cel.Variable("now", cel.TimestampType),
+		cel.ParserExpressionSizeLimit(maxConditionLength),
+	)
+	if err != nil {
+		panic(err.Error())
+	}
+	return env
+}
+
+// compileCondition checks the expression and returns the program that evaluates it
+func compileCondition(expression string) (cel.Program, error) {
+	if len(expression) > maxConditionLength {
+		return nil, fmt.Errorf("longer than %d characters", maxConditionLength)
+	}
+
+	ast, issues := conditionEnv.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("must be a boolean expression, not %s", ast.OutputType())
+	}
+
+	return conditionEnv.Program(ast, cel.CostLimit(maxConditionCost))
+}
+
+// permissionRequest - a command checked against the user permissions
+type permissionRequest struct {
+	cmd      string
+	args     []interface{}
+	username string
+	pcKey    string
+	time     time.Time
+	paths    pathFlavor // how the PC writes its paths
+}
+
+// evalCondition returns true only if the condition evaluates to true, errors deny the command
+func evalCondition(program cel.Program, request permissionRequest) bool {
+	args := request.args
+	if args == nil {
+		args = []interface{}{}
+	}
+
+	result, _, err := program.Eval(map[string]interface{}{
+		"cmd":      request.cmd,
+		"args":     args,
+		"username": request.username,
+		"pc_key":   request.pcKey,
+		"now":      request.time,
+	})
+	if err != nil {
+		return false
+	}
+
+	allow, ok := result.Value().(bool)
+	return ok && allow
+}
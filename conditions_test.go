@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompileCondition(t *testing.T) {
+	tests := []struct {
+		condition string
+		valid     bool
+	}{
+		{`args[0].endsWith(".tmp")`, true},
+		{`now.getHours("America/Sao_Paulo") >= 8 && now.getHours("America/Sao_Paulo") < 18`, true},
+		{`username == "alice" || pc_key.startsWith("lab-")`, true},
+		{`cmd in ["ls_dir", "download_file"]`, true},
+		{`args[0].endsWith(".tmp"`, false}, // syntax error
+		{`size(args)`, false},              // not a boolean
+		{`user == "alice"`, false},         // unknown variable
+		{`exec("rm -rf /")`, false},        // unknown function
+		{`args[0] == "` + strings.Repeat("a", maxConditionLength) + `"`, false},
+	}
+
+	for _, test := range tests {
+		_, err := compileCondition(test.condition)
+		assert.Equal(t, test.valid, err == nil, "%s: %v", test.condition, err)
+	}
+}
+
+func TestEvalCondition(t *testing.T) {
+	location, err := time.LoadLocation("America/Sao_Paulo")
+	assert.Nil(t, err)
+	morning := time.Date(2020, 1, 6, 9, 30, 0, 0, location)
+	night := time.Date(2020, 1, 6, 22, 0, 0, 0, location)
+
+	businessHours := `now.getHours("America/Sao_Paulo") >= 8 && now.getHours("America/Sao_Paulo") < 18`
+	manyArgs := make([]interface{}, 50)
+	for i := range manyArgs {
+		manyArgs[i] = "arg"
+	}
+
+	tests := []struct {
+		condition string
+		request   permissionRequest
+		allow     bool
+	}{
+		{`args[0].endsWith(".tmp")`, permissionRequest{cmd: "delete_file", args: []interface{}{"/tmp/file.tmp"}}, true},
+		{`args[0].endsWith(".tmp")`, permissionRequest{cmd: "delete_file", args: []interface{}{"/tmp/file.txt"}}, false},
+		{`args[0].endsWith(".tmp")`, permissionRequest{cmd: "delete_file"}, false},                         // no args, evaluation error
+		{`args[0].endsWith(".tmp")`, permissionRequest{cmd: "delete_file", args: []interface{}{1}}, false}, // not a string
+		{businessHours, permissionRequest{cmd: "download_file", time: morning}, true},
+		{businessHours, permissionRequest{cmd: "download_file", time: night}, false},
+		{`username == "alice" && pc_key == "key"`, permissionRequest{username: "alice", pcKey: "key"}, true},
+		{`username == "alice" && pc_key == "key"`, permissionRequest{username: "bob", pcKey: "key"}, false},
+		// too expensive, stopped
+		{`args.all(a, args.all(b, args.all(c, a == b || b != c)))`, permissionRequest{args: manyArgs}, false},
+	}
+
+	for _, test := range tests {
+		program, err := compileCondition(test.condition)
+		assert.Nil(t, err, test.condition)
+		assert.Equal(t, test.allow, evalCondition(program, test.request), "%s %v", test.condition, test.request.args)
+	}
+}
+
+func TestPermissionConditions(t *testing.T) {
+	stored := Json{"commands": Json{
+		"delete_file": Json{
+			"allow":        true,
+			"restrictions": []interface{}{Json{"path": "/etc", "allow": false}},
+			"condition":    `args[0].endsWith(".tmp")`,
+		},
+	}}
+
+	_, err := ParsePermissions(stored)
+	assert.Nil(t, err)
+
+	user := NewUser(&UserRecord{Username: "alice", Permissions: stored}, nil, false)
+	assert.True(t, user.havePermission("delete_file", []interface{}{"/home/alice/file.tmp"}))
+	assert.False(t, user.havePermission("delete_file", []interface{}{"/home/alice/file.txt"}))
+	assert.False(t, user.havePermission("delete_file", []interface{}{"/etc/file.tmp"}), "the path must be allowed too")
+
+	_, err = ParsePermissions(Json{"commands": Json{
+		"ls_dir":      Json{"allow": true, "condition": `size(args)`},
+		"delete_file": Json{"allow": true, "condition": true},
+	}})
+	assert.Len(t, err, 2)
+	assert.Equal(t, "commands.delete_file.condition", err[0].Field)
+	assert.Equal(t, "must be a string", err[0].Error)
+	assert.Equal(t, "commands.ls_dir.condition", err[1].Field)
+	assert.Contains(t, err[1].Error, "must be a boolean expression")
+
+	// a stored condition that doesn't compile anymore denies the command
+	legacy := Json{"commands": Json{"ls_dir": Json{"allow": true, "condition": `user == "alice"`}}}
+	user = NewUser(&UserRecord{Username: "alice", Permissions: legacy}, nil, false)
+	assert.False(t, user.havePermission("ls_dir", []interface{}{"/home"}))
+}
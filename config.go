@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const redacted = "********"
+
+// Duration - time.Duration written as "30s", "15m" in the configuration file
+type Duration time.Duration
+
+func (duration *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*duration = Duration(parsed)
+	return nil
+}
+
+func (duration Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(duration).String(), nil
+}
+
+type ListenConfig struct {
+	Host string `yaml:"host"`
+	Port string `yaml:"port"`
+}
+
+type AdminConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type StorageConfig struct {
+	Backend   string `yaml:"backend"` // mongo or memory
+	MongoHost string `yaml:"mongo_host"`
+	Database  string `yaml:"database"`
+}
+
+type TimeoutsConfig struct {
+	ShutdownDrain   Duration `yaml:"shutdown_drain"`
+	Write           Duration `yaml:"write"`
+	Command         Duration `yaml:"command"` // how long the PC has to reply to a command
+	AccessTokenTTL  Duration `yaml:"access_token_ttl"`
+	RefreshTokenTTL Duration `yaml:"refresh_token_ttl"`
+}
+
+type LimitsConfig struct {
+	OutboundQueue   int   `yaml:"outbound_queue"`   // messages
+	MaxMessageSize  int64 `yaml:"max_message_size"` // bytes, 0 for no limit
+	PendingCommands int   `yaml:"pending_commands"` // commands a session can have waiting for the PC
+}
+
+/*
+Config - everything the server can be configured with
+
+Values come from the defaults, then the configuration file (YAML), then
+environment variables, see Config.envVars.
+Every variable can also be read from a file by appending _FILE to its name (Docker secrets)
+*/
+type Config struct {
+	Listen      ListenConfig   `yaml:"listen"`
+	Admin       AdminConfig    `yaml:"admin"`
+	TokenSecret string         `yaml:"token_secret"`
+	Storage     StorageConfig  `yaml:"storage"`
+	Timeouts    TimeoutsConfig `yaml:"timeouts"`
+	Limits      LimitsConfig   `yaml:"limits"`
+	TLS         TLSSettings    `yaml:"tls"`
+}
+
+// ConfigError - every problem found in the configuration
+type ConfigError []string
+
+func (configErr ConfigError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(configErr, "\n  ")
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:  ListenConfig{Port: "9002"},
+		Storage: StorageConfig{Backend: "mongo", MongoHost: "mongo:27017", Database: "remote_pc"},
+		Timeouts: TimeoutsConfig{
+			ShutdownDrain:   Duration(defaultShutdownDrain),
+			Write:           Duration(writeWait),
+			Command:         Duration(commandTimeout),
+			AccessTokenTTL:  Duration(accessTokenTTL),
+			RefreshTokenTTL: Duration(refreshTokenTTL),
+		},
+		Limits: LimitsConfig{OutboundQueue: outboundQueueSize, MaxMessageSize: maxMessageSize, PendingCommands: maxPendingCommands},
+		TLS:    TLSSettings{MinVersion: "1.2", CipherPolicy: "modern"},
+	}
+}
+
+type envVar struct {
+	name string
+	set  func(value string) error
+}
+
+func setString(field *string) func(string) error {
+	return func(value string) error {
+		*field = value
+		return nil
+	}
+}
+
+func setDuration(field *Duration) func(string) error {
+	return func(value string) error {
+		parsed, err := time.ParseDuration(value)
+		if err == nil {
+			*field = Duration(parsed)
+		}
+		return err
+	}
+}
+
+func setInt(field *int) func(string) error {
+	return func(value string) error {
+		parsed, err := strconv.Atoi(value)
+		if err == nil {
+			*field = parsed
+		}
+		return err
+	}
+}
+
+func setInt64(field *int64) func(string) error {
+	return func(value string) error {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err == nil {
+			*field = parsed
+		}
+		return err
+	}
+}
+
+// envVars - environment variables that override the configuration file
+func (config *Config) envVars() []envVar {
+	return []envVar{
+		{"LISTEN_HOST", setString(&config.Listen.Host)},
+		{"PORT", setString(&config.Listen.Port)},
+		{"ADMIN_USER", setString(&config.Admin.Username)},
+		{"ADMIN_PASSWORD", setString(&config.Admin.Password)},
+		{"TOKEN_SECRET", setString(&config.TokenSecret)},
+		{"STORAGE", setString(&config.Storage.Backend)},
+		{"MONGODB_HOST", setString(&config.Storage.MongoHost)},
+		{"MONGODB_DATABASE", setString(&config.Storage.Database)},
+		{"SHUTDOWN_DRAIN", setDuration(&config.Timeouts.ShutdownDrain)},
+		{"WRITE_TIMEOUT", setDuration(&config.Timeouts.Write)},
+		{"COMMAND_TIMEOUT", setDuration(&config.Timeouts.Command)},
+		{"ACCESS_TOKEN_TTL", setDuration(&config.Timeouts.AccessTokenTTL)},
+		{"REFRESH_TOKEN_TTL", setDuration(&config.Timeouts.RefreshTokenTTL)},
+		{"OUTBOUND_QUEUE_SIZE", setInt(&config.Limits.OutboundQueue)},
+		{"MAX_MESSAGE_SIZE", setInt64(&config.Limits.MaxMessageSize)},
+		{"PENDING_COMMANDS", setInt(&config.Limits.PendingCommands)},
+		{"TLS_CERT_FILE", setString(&config.TLS.CertFile)},
+		{"TLS_KEY_FILE", setString(&config.TLS.KeyFile)},
+		{"TLS_MIN_VERSION", setString(&config.TLS.MinVersion)},
+		{"TLS_CIPHERS", setString(&config.TLS.CipherPolicy)},
+		{"HTTP_REDIRECT_PORT", setString(&config.TLS.RedirectPort)},
+	}
+}
+
+/*
+LoadConfig reads the configuration file (if path isn't empty), applies the
+environment variables found by lookupEnv and validates the result
+*/
+func LoadConfig(path string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	config := defaultConfig()
+
+	if path != "" {
+		if ext := filepath.Ext(path); ext != ".yaml" && ext != ".yml" {
+			return nil, fmt.Errorf("unsupported configuration file %s (must be .yaml or .yml)", path)
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, config); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %s", path, err.Error())
+		}
+	}
+
+	problems := config.applyEnv(lookupEnv)
+	problems = append(problems, config.validate()...)
+	if len(problems) > 0 {
+		return config, ConfigError(problems)
+	}
+	return config, nil
+}
+
+func (config *Config) applyEnv(lookupEnv func(string) (string, bool)) []string {
+	problems := make([]string, 0)
+
+	for _, env := range config.envVars() {
+		value, found := lookupEnv(env.name)
+
+		if file, fileFound := lookupEnv(env.name + "_FILE"); fileFound {
+			if found {
+				problems = append(problems, fmt.Sprintf("%s and %s_FILE can't be defined together", env.name, env.name))
+				continue
+			}
+
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s_FILE: %s", env.name, err.Error()))
+				continue
+			}
+			value, found = strings.TrimRight(string(data), "\r\n"), true
+		}
+
+		if found {
+			if err := env.set(value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid value %q", env.name, value))
+			}
+		}
+	}
+
+	return problems
+}
+
+var (
+	portRegex      = regexp.MustCompile(`^\d+$`)
+	mongoHostRegex = regexp.MustCompile(`^[a-zA-Z0-9\.\-]+:\d+$`)
+)
+
+func validPort(port string) bool {
+	number, err := strconv.Atoi(port)
+	return portRegex.MatchString(port) && err == nil && number > 0 && number < 65536
+}
+
+// validate returns every problem found, so they can be fixed at once
+func (config *Config) validate() []string {
+	problems := make([]string, 0)
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if !validPort(config.Listen.Port) {
+		problem("listen.port: invalid port %q", config.Listen.Port)
+	}
+
+	if config.Admin.Username == "" {
+		problem("admin.username: required (ADMIN_USER)")
+	}
+	if config.Admin.Password == "" {
+		problem("admin.password: required (ADMIN_PASSWORD)")
+	}
+
+	switch config.Storage.Backend {
+	case "memory":
+	case "mongo":
+		if !mongoHostRegex.MatchString(config.Storage.MongoHost) {
+			problem("storage.mongo_host: invalid host %q (must be host:port)", config.Storage.MongoHost)
+		}
+		if config.Storage.Database == "" {
+			problem("storage.database: required")
+		}
+	default:
+		problem("storage.backend: invalid backend %q (must be mongo or memory)", config.Storage.Backend)
+	}
+
+	if config.Timeouts.ShutdownDrain < 0 {
+		problem("timeouts.shutdown_drain: can't be negative")
+	}
+	if config.Timeouts.Write <= 0 {
+		problem("timeouts.write: must be positive")
+	}
+	if config.Timeouts.Command <= 0 {
+		problem("timeouts.command: must be positive")
+	}
+	if config.Timeouts.AccessTokenTTL <= 0 {
+		problem("timeouts.access_token_ttl: must be positive")
+	}
+	if config.Timeouts.RefreshTokenTTL < config.Timeouts.AccessTokenTTL {
+		problem("timeouts.refresh_token_ttl: can't be shorter than access_token_ttl")
+	}
+
+	if config.Limits.OutboundQueue <= 0 {
+		problem("limits.outbound_queue: must be positive")
+	}
+	if config.Limits.MaxMessageSize < 0 {
+		problem("limits.max_message_size: can't be negative")
+	}
+	if config.Limits.PendingCommands <= 0 {
+		problem("limits.pending_commands: must be positive")
+	}
+
+	tls := config.TLS
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		problem("tls: cert_file and key_file must be defined together")
+	}
+	if _, found := tlsVersions[tls.MinVersion]; !found {
+		problem("tls.min_version: invalid version %q (must be 1.2 or 1.3)", tls.MinVersion)
+	}
+	if tls.CipherPolicy != "modern" && tls.CipherPolicy != "compatible" {
+		problem("tls.ciphers: invalid policy %q (must be modern or compatible)", tls.CipherPolicy)
+	}
+	if tls.RedirectPort != "" {
+		if !validPort(tls.RedirectPort) {
+			problem("tls.redirect_port: invalid port %q", tls.RedirectPort)
+		} else if tls.RedirectPort == config.Listen.Port {
+			problem("tls.redirect_port: can't be the same as listen.port")
+		}
+		if !config.tlsEnabled() {
+			problem("tls.redirect_port: requires cert_file and key_file")
+		}
+	}
+
+	return problems
+}
+
+func (config *Config) tlsEnabled() bool {
+	return config.TLS.CertFile != "" && config.TLS.KeyFile != ""
+}
+
+// Address - address the server listens on
+func (config *Config) Address() string {
+	return net.JoinHostPort(config.Listen.Host, config.Listen.Port)
+}
+
+// TLSSettings returns nil if TLS is disabled
+func (config *Config) TLSSettings() *TLSSettings {
+	if !config.tlsEnabled() {
+		return nil
+	}
+	settings := config.TLS
+	return &settings
+}
+
+// apply sets the limits and timeouts used by connections and tokens
+func (config *Config) apply() {
+	writeWait = time.Duration(config.Timeouts.Write)
+	commandTimeout = time.Duration(config.Timeouts.Command)
+	accessTokenTTL = time.Duration(config.Timeouts.AccessTokenTTL)
+	refreshTokenTTL = time.Duration(config.Timeouts.RefreshTokenTTL)
+	outboundQueueSize = config.Limits.OutboundQueue
+	maxMessageSize = config.Limits.MaxMessageSize
+	maxPendingCommands = config.Limits.PendingCommands
+}
+
+// String - the configuration as YAML, secrets are hidden
+func (config *Config) String() string {
+	printed := *config
+	if printed.Admin.Password != "" {
+		printed.Admin.Password = redacted
+	}
+	if printed.TokenSecret != "" {
+		printed.TokenSecret = redacted
+	}
+
+	data, err := yaml.Marshal(printed)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
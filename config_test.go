@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func envMap(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, found := env[name]
+		return value, found
+	}
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	required := map[string]string{"ADMIN_USER": "admin", "ADMIN_PASSWORD": "admin"}
+
+	t.Run("Defaults", func(t *testing.T) {
+		config, err := LoadConfig("", envMap(required))
+		assert.Nil(t, err)
+		assert.Equal(t, ":9002", config.Address())
+		assert.Equal(t, "mongo", config.Storage.Backend)
+		assert.Equal(t, 30*time.Second, time.Duration(config.Timeouts.ShutdownDrain))
+		assert.Nil(t, config.TLSSettings())
+	})
+
+	t.Run("FileWithEnvOverrides", func(t *testing.T) {
+		path := writeFile(t, dir, "config.yaml", `
+listen:
+  host: 127.0.0.1
+  port: "8080"
+admin:
+  username: root
+  password: secret
+storage:
+  backend: memory
+timeouts:
+  shutdown_drain: 1m
+  command: 2m
+limits:
+  outbound_queue: 16
+`)
+		config, err := LoadConfig(path, envMap(map[string]string{"PORT": "9000", "SHUTDOWN_DRAIN": "5s"}))
+		assert.Nil(t, err)
+		assert.Equal(t, "127.0.0.1:9000", config.Address())
+		assert.Equal(t, "root", config.Admin.Username)
+		assert.Equal(t, "memory", config.Storage.Backend)
+		assert.Equal(t, 5*time.Second, time.Duration(config.Timeouts.ShutdownDrain))
+		assert.Equal(t, 2*time.Minute, time.Duration(config.Timeouts.Command))
+		assert.Equal(t, 16, config.Limits.OutboundQueue)
+	})
+
+	t.Run("FileVariants", func(t *testing.T) {
+		env := map[string]string{
+			"ADMIN_USER":          "admin",
+			"ADMIN_PASSWORD_FILE": writeFile(t, dir, "password", "from secret\n"),
+		}
+		config, err := LoadConfig("", envMap(env))
+		assert.Nil(t, err)
+		assert.Equal(t, "from secret", config.Admin.Password)
+
+		env["ADMIN_PASSWORD"] = "both"
+		_, err = LoadConfig("", envMap(env))
+		assert.Contains(t, err.Error(), "ADMIN_PASSWORD and ADMIN_PASSWORD_FILE can't be defined together")
+
+		delete(env, "ADMIN_PASSWORD")
+		env["ADMIN_PASSWORD_FILE"] = filepath.Join(dir, "missing")
+		_, err = LoadConfig("", envMap(env))
+		assert.Contains(t, err.Error(), "ADMIN_PASSWORD_FILE")
+	})
+
+	t.Run("EveryProblemIsReported", func(t *testing.T) {
+		env := map[string]string{
+			"PORT":                "http",
+			"STORAGE":             "postgres",
+			"SHUTDOWN_DRAIN":      "forever",
+			"OUTBOUND_QUEUE_SIZE": "0",
+			"TLS_CERT_FILE":       "cert.pem",
+			"TLS_MIN_VERSION":     "1.0",
+		}
+		_, err := LoadConfig("", envMap(env))
+		configErr, ok := err.(ConfigError)
+		assert.True(t, ok)
+
+		problems := strings.Join(configErr, "\n")
+		for _, expected := range []string{
+			"listen.port", "admin.username", "admin.password", "storage.backend",
+			"SHUTDOWN_DRAIN", "limits.outbound_queue", "tls: cert_file and key_file", "tls.min_version",
+		} {
+			assert.Contains(t, problems, expected)
+		}
+		assert.Len(t, configErr, 8)
+	})
+
+	t.Run("InvalidFile", func(t *testing.T) {
+		_, err := LoadConfig(writeFile(t, dir, "config.toml", ""), envMap(required))
+		assert.Error(t, err)
+
+		_, err = LoadConfig(writeFile(t, dir, "unknown.yaml", "listen:\n  address: x\n"), envMap(required))
+		assert.Error(t, err, "unknown fields are rejected")
+
+		_, err = LoadConfig(writeFile(t, dir, "duration.yaml", "timeouts:\n  write: 10\n"), envMap(required))
+		assert.Error(t, err)
+	})
+
+	t.Run("PrintHidesSecrets", func(t *testing.T) {
+		env := map[string]string{"ADMIN_USER": "admin", "ADMIN_PASSWORD": "hunter2", "TOKEN_SECRET": "token secret"}
+		config, err := LoadConfig("", envMap(env))
+		assert.Nil(t, err)
+
+		printed := config.String()
+		assert.NotContains(t, printed, "hunter2")
+		assert.NotContains(t, printed, "token secret")
+		assert.Contains(t, printed, "shutdown_drain: 30s")
+		assert.Equal(t, "hunter2", config.Admin.Password)
+	})
+}
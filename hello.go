@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// helloTimeout - how long a PC has to send its hello after connecting
+const helloTimeout = 10 * time.Second
+
+var errHelloType = errors.New("expected a hello message")
+
+/*
+pcHello - the first message a PC sends, what it is and which commands it can run
+
+It is a version 1 message in every version, protocol_version is the highest version the PC speaks
+
+	{"type": "hello", "agent_version": "1.4.0", "os": "windows", "hostname": "desktop",
+	 "protocol_version": 1, "commands": ["ls_dir", "download_file"]}
+
+Users get it (info 0xf7) when they attach
+*/
+type pcHello struct {
+	AgentVersion    string   `json:"agent_version"`
+	OS              string   `json:"os"`
+	Hostname        string   `json:"hostname"`
+	ProtocolVersion int      `json:"protocol_version"`
+	Commands        []string `json:"commands"`
+}
+
+// negotiatedVersion - the highest protocol version both the PC and the server speak
+func (hello pcHello) negotiatedVersion() int {
+	if hello.ProtocolVersion > protocolVersion {
+		return protocolVersion
+	}
+	return hello.ProtocolVersion
+}
+
+// readHello waits for the hello of the PC, any other message is an error
+func readHello(conn *websocket.Conn) (pcHello, error) {
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	msgType, data, err := conn.ReadMessage()
+	if err != nil {
+		return pcHello{}, err
+	}
+	if msgType != websocket.TextMessage {
+		return pcHello{}, errHelloType
+	}
+
+	var msg struct {
+		Type string `json:"type"`
+		pcHello
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return pcHello{}, fmt.Errorf("invalid hello: %s", err.Error())
+	}
+	if msg.Type != helloType {
+		return pcHello{}, errHelloType
+	}
+	return msg.pcHello, msg.validate()
+}
+
+func (hello pcHello) validate() error {
+	if hello.ProtocolVersion < minProtocolVersion {
+		return fmt.Errorf("unsupported protocol version %d, the server speaks %d to %d", hello.ProtocolVersion, minProtocolVersion, protocolVersion)
+	}
+	if len(strings.TrimSpace(hello.AgentVersion)) == 0 || len(strings.TrimSpace(hello.Hostname)) == 0 {
+		return errors.New("agent_version and hostname are required")
+	}
+	if hello.Commands == nil {
+		return errors.New("commands is required")
+	}
+	_, err := parsePathFlavor(hello.OS)
+	return err
+}
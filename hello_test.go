@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPcHandshake(t *testing.T) {
+	store := NewMemoryStore()
+	if err := setup(store); err != nil {
+		panic(err.Error())
+	}
+
+	wsController := NewWsController("admin", "admin", store, "")
+	server := httptest.NewServer(wsController.routes())
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	authHeader := http.Header{"X-Username": []string{"username"}, "X-Password": []string{"passwd"}}
+
+	invalid := []struct {
+		hello  Json
+		reason string
+	}{
+		{Json{"type": "command", "cmd": "ls_dir"}, "expected a hello message"},
+		{Json{"type": "hello", "agent_version": "1.0.0", "os": "linux", "hostname": "test", "protocol_version": 0, "commands": []interface{}{}}, "unsupported protocol version 0, the server speaks 1 to 2"},
+		{Json{"type": "hello", "agent_version": "1.0.0", "os": "plan9", "hostname": "test", "protocol_version": 1, "commands": []interface{}{}}, `unknown OS "plan9"`},
+		{Json{"type": "hello", "agent_version": "1.0.0", "os": "linux", "protocol_version": 1, "commands": []interface{}{}}, "agent_version and hostname are required"},
+		{Json{"type": "hello", "agent_version": "1.0.0", "os": "linux", "hostname": "test", "protocol_version": 1}, "commands is required"},
+		// the reason is cut to fit in the close frame
+		{Json{"type": "hello", "agent_version": "1.0.0", "os": strings.Repeat("é", 100), "hostname": "test", "protocol_version": 1, "commands": []interface{}{}}, `unknown OS "é`},
+	}
+
+	for _, test := range invalid {
+		_, _, err := dialPC(wsURL+"/connect/"+key, authHeader, test.hello)
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseProtocolError), "%v", test.hello)
+		assert.Contains(t, err.Error(), test.reason)
+		assert.Nil(t, wsController.remotePcs.get(key))
+	}
+
+	hello := testHello("linux")
+	hello["commands"] = []interface{}{"ls_dir"}
+	wsPcConn, _, err := dialPC(wsURL+"/connect/"+key, authHeader, hello)
+	assert.Nil(t, err)
+	defer wsPcConn.Close()
+
+	// users are told what the PC is when they attach
+	userConn, _, err := websocket.DefaultDialer.Dial(wsURL+"/access/"+key, authHeader)
+	assert.Nil(t, err)
+	defer userConn.Close()
+
+	info := make(Json)
+	assert.Nil(t, userConn.ReadJSON(&info))
+	assert.Equal(t, float64(0xf7), info["code"])
+	assert.Equal(t, Json{"agent_version": "1.0.0", "os": "linux", "hostname": "test", "protocol_version": float64(1), "commands": []interface{}{"ls_dir"}}, info["data"])
+	assert.Nil(t, wsPcConn.ReadJSON(&info))
+
+	// and can't send commands it doesn't support
+	assert.Nil(t, userConn.WriteJSON(Json{"type": "command", "cmd": "power", "args": []interface{}{"restart"}}))
+	msg := make(Json)
+	assert.Nil(t, userConn.ReadJSON(&msg))
+	assert.Equal(t, float64(NotSupported), msg["error_code"])
+
+	assert.Nil(t, userConn.WriteJSON(Json{"type": "command", "cmd": "ls_dir", "args": []interface{}{"/home/test"}}))
+	msg = make(Json)
+	assert.Nil(t, wsPcConn.ReadJSON(&msg))
+	assert.Equal(t, "ls_dir", msg["cmd"])
+}
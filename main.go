@@ -1,68 +1,112 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"regexp"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 type Json = map[string]interface{}
 
-func loadEnvVars() (string, string, string, string) {
-	mongoDbHost, found := os.LookupEnv("MONGODB_HOST")
+func main() {
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration and exit")
+	flag.Parse()
 
-	if !found {
-		log.Printf("MONGODB_HOST not defined, using default (mongo:27017)")
-		mongoDbHost = "mongo:27017"
-	} else {
-		re := regexp.MustCompile(`(^[a-zA-z0-9\.]+:\d+)`)
-		if !re.Match([]byte(mongoDbHost)) {
-			log.Printf("Invalid mongodb host: %s\n", mongoDbHost)
-			os.Exit(1)
-		}
+	config, err := LoadConfig(*configFile, os.LookupEnv)
+	if *printConfig && config != nil {
+		fmt.Print(config.String())
+	}
+	if err != nil {
+		log.Printf("%s\n", err.Error())
+		os.Exit(1)
 	}
+	if *printConfig {
+		return
+	}
+	config.apply()
 
-	port, found := os.LookupEnv("PORT")
-	if !found {
-		log.Printf("PORT not defined, using default (9002)")
-		port = "9002"
+	var store Store
+	if config.Storage.Backend == "memory" {
+		log.Printf("Using in-memory storage, nothing will be persisted")
+		store = NewMemoryStore()
 	} else {
-		re := regexp.MustCompile(`\d+`)
-		if !re.Match([]byte(port)) {
-			log.Printf("Invalid port: %s\n", port)
+		mongoStore, err := NewMongoStore(config.Storage.MongoHost, config.Storage.Database)
+		if err != nil {
+			log.Printf("Failed to connect to mongodb host: %s\nError: %s\n", config.Storage.MongoHost, err.Error())
 			os.Exit(1)
 		}
+		store = mongoStore
 	}
 
-	/*Admin username and password will be used
-	to register a remote PC and users that will access this PC*/
-	adminUser, found := os.LookupEnv("ADMIN_USER")
-	if !found {
-		log.Printf("Required ADMIN_USER environment variable not defined")
-		os.Exit(1)
+	if config.TokenSecret == "" {
+		log.Printf("TOKEN_SECRET not defined, using a random one (tokens will not survive a restart)")
 	}
 
-	adminPassword, found := os.LookupEnv("ADMIN_PASSWORD")
-	if !found {
-		log.Printf("Required ADMIN_PASSWORD environment variable not defined")
-		os.Exit(1)
-	}
+	wsController := NewWsController(config.Admin.Username, config.Admin.Password, store, config.TokenSecret)
 
-	return mongoDbHost, port, adminUser, adminPassword
-}
+	port := config.Listen.Port
+	server := &http.Server{Addr: config.Address(), Handler: wsController.routes()}
+	var redirectServer *http.Server
 
-func main() {
+	if tlsSettings := config.TLSSettings(); tlsSettings != nil {
+		tlsConfig, certReloader, err := newTLSConfig(*tlsSettings)
+		if err != nil {
+			log.Printf("Failed to load TLS certificate\nError: %s\n", err.Error())
+			os.Exit(1)
+		}
+		defer certReloader.stop()
+		server.TLSConfig = tlsConfig
 
-	mongoDbHost, port, adminUsername, adminPassword := loadEnvVars()
+		if tlsSettings.RedirectPort != "" {
+			redirectServer = &http.Server{Addr: net.JoinHostPort(config.Listen.Host, tlsSettings.RedirectPort), Handler: httpsRedirect(port)}
+			go func() {
+				fmt.Println("Redirecting to HTTPS on port: " + tlsSettings.RedirectPort)
+				if err := redirectServer.ListenAndServe(); err != http.ErrServerClosed {
+					log.Printf("Failed to start the redirect server\nError: %s\n", err.Error())
+					os.Exit(1)
+				}
+			}()
+		}
+	}
 
-	wsController := NewWsController(adminUsername, adminPassword, mongoDbHost, "remote_pc")
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			fmt.Println("Listening with TLS on port: " + port)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			fmt.Println("Listening on port: " + port)
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Printf("Failed to start the server\nError: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Received %s", <-signals)
 
-	http.Handle("/", wsController.routes())
+	wsController.Shutdown(time.Duration(config.Timeouts.ShutdownDrain))
 
-	go wsController.disconnectPCRoutine()
+	ctx, cancel := context.WithTimeout(context.Background(), closeGracePeriod)
+	defer cancel()
+	if redirectServer != nil {
+		redirectServer.Shutdown(ctx)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to stop the server\nError: %s\n", err.Error())
+	}
 
-	fmt.Println("Listening on port: " + port)
-	http.ListenAndServe(":"+port, nil)
+	store.Close()
+	log.Printf("Server stopped")
 }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// MemoryStore - Store that keeps everything in memory, nothing survives a restart
+type MemoryStore struct {
+	mutex sync.RWMutex
+	pcs   map[string]PCRecord
+	users map[string]UserRecord // indexed by userKey(username, pcKey)
+	roles map[string]RoleRecord
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		pcs:   make(map[string]PCRecord),
+		users: make(map[string]UserRecord),
+		roles: make(map[string]RoleRecord),
+	}
+}
+
+func userKey(username, pcKey string) string {
+	return pcKey + "/" + username
+}
+
+func (store *MemoryStore) FindPC(key string) (*PCRecord, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	pc, found := store.pcs[key]
+	if !found {
+		return nil, ErrNotFound
+	}
+	return &pc, nil
+}
+
+func (store *MemoryStore) InsertPC(pc *PCRecord) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.pcs[pc.Key] = *pc
+	return nil
+}
+
+func (store *MemoryStore) SetPCPassword(key, password string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	pc, found := store.pcs[key]
+	if !found {
+		return ErrNotFound
+	}
+
+	pc.Password = password
+	store.pcs[key] = pc
+	return nil
+}
+
+func (store *MemoryStore) FindUser(username, pcKey string) (*UserRecord, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	user, found := store.users[userKey(username, pcKey)]
+	if !found {
+		return nil, ErrNotFound
+	}
+
+	permissions, err := copyJson(user.Permissions)
+	if err != nil {
+		return nil, err
+	}
+	user.Permissions = permissions
+	user.Roles = append([]string(nil), user.Roles...)
+	user.Access = user.Access.copy()
+
+	return &user, nil
+}
+
+func (store *MemoryStore) InsertUser(user *UserRecord) error {
+	permissions, err := copyJson(user.Permissions)
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	record := *user
+	record.Permissions = permissions
+	record.Roles = append([]string(nil), user.Roles...)
+	record.Access = user.Access.copy()
+	store.users[userKey(user.Username, user.PcKey)] = record
+	return nil
+}
+
+func (store *MemoryStore) SetUserPassword(username, pcKey, password string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	key := userKey(username, pcKey)
+	user, found := store.users[key]
+	if !found {
+		return ErrNotFound
+	}
+
+	user.Password = password
+	store.users[key] = user
+	return nil
+}
+
+func (store *MemoryStore) SetUserPermissions(username, pcKey string, permissions Json) error {
+	permissions, err := copyJson(permissions)
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	key := userKey(username, pcKey)
+	user, found := store.users[key]
+	if !found {
+		return ErrNotFound
+	}
+
+	user.Permissions = permissions
+	store.users[key] = user
+	return nil
+}
+
+func (store *MemoryStore) SetUserAccess(username, pcKey string, access *UserAccess) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	key := userKey(username, pcKey)
+	user, found := store.users[key]
+	if !found {
+		return ErrNotFound
+	}
+
+	user.Access = access.copy()
+	store.users[key] = user
+	return nil
+}
+
+func (store *MemoryStore) SetUserObserverOnly(username, pcKey string, observerOnly bool) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	key := userKey(username, pcKey)
+	user, found := store.users[key]
+	if !found {
+		return ErrNotFound
+	}
+
+	user.ObserverOnly = observerOnly
+	store.users[key] = user
+	return nil
+}
+
+func (store *MemoryStore) SetUserRoles(username, pcKey string, roles []string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	key := userKey(username, pcKey)
+	user, found := store.users[key]
+	if !found {
+		return ErrNotFound
+	}
+
+	user.Roles = append([]string(nil), roles...)
+	store.users[key] = user
+	return nil
+}
+
+func (store *MemoryStore) DeleteUser(username, pcKey string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	key := userKey(username, pcKey)
+	if _, found := store.users[key]; !found {
+		return ErrNotFound
+	}
+
+	delete(store.users, key)
+	return nil
+}
+
+func (store *MemoryStore) FindRole(name string) (*RoleRecord, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	role, found := store.roles[name]
+	if !found {
+		return nil, ErrNotFound
+	}
+
+	permissions, err := copyJson(role.Permissions)
+	if err != nil {
+		return nil, err
+	}
+	role.Permissions = permissions
+
+	return &role, nil
+}
+
+func (store *MemoryStore) InsertRole(role *RoleRecord) error {
+	permissions, err := copyJson(role.Permissions)
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.roles[role.Name] = RoleRecord{Name: role.Name, Permissions: permissions}
+	return nil
+}
+
+func (store *MemoryStore) SetRolePermissions(name string, permissions Json) error {
+	permissions, err := copyJson(permissions)
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	role, found := store.roles[name]
+	if !found {
+		return ErrNotFound
+	}
+
+	role.Permissions = permissions
+	store.roles[name] = role
+	return nil
+}
+
+func (store *MemoryStore) Close() error {
+	return nil
+}
+
+// copyJson makes a deep copy, so callers can't change what is stored
+func copyJson(doc Json) (Json, error) {
+	if doc == nil {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	docCopy := make(Json)
+	err = json.Unmarshal(data, &docCopy)
+	return docCopy, err
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// MongoStore - Store backed by a mongodb database
+type MongoStore struct {
+	client *mongo.Client
+	db     *mongo.Database
+}
+
+// NewMongoStore connects to the mongodb host and checks if its reachable
+func NewMongoStore(mongoDbHost, dbName string) (*MongoStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+mongoDbHost))
+	defer cancel()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// check if its connected
+	ctx, cancel = context.WithTimeout(context.Background(), 4*time.Second)
+	err = client.Ping(ctx, readpref.Primary())
+	defer cancel()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &MongoStore{client: client, db: client.Database(dbName)}, nil
+}
+
+func (store *MongoStore) FindPC(key string) (*PCRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	result := store.db.Collection("pcs").FindOne(ctx, bson.M{"key": key})
+	if result.Err() != nil {
+		return nil, mongoError(result.Err())
+	}
+
+	pc := &PCRecord{}
+	if err := result.Decode(pc); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+func (store *MongoStore) InsertPC(pc *PCRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := store.db.Collection("pcs").InsertOne(ctx, pc)
+	return err
+}
+
+func (store *MongoStore) SetPCPassword(key, password string) error {
+	return store.updateOne("pcs", bson.M{"key": key}, bson.M{"password": password})
+}
+
+func (store *MongoStore) FindUser(username, pcKey string) (*UserRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result := store.db.Collection("users").FindOne(ctx, bson.M{"username": username, "pc_key": pcKey})
+	if result.Err() != nil {
+		return nil, mongoError(result.Err())
+	}
+
+	user := &UserRecord{}
+	if err := result.Decode(user); err != nil {
+		return nil, err
+	}
+
+	permissions, err := bsonToJson(user.Permissions)
+	if err != nil {
+		return nil, err
+	}
+	user.Permissions = permissions
+
+	return user, nil
+}
+
+func (store *MongoStore) InsertUser(user *UserRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := store.db.Collection("users").InsertOne(ctx, user)
+	return err
+}
+
+func (store *MongoStore) SetUserPassword(username, pcKey, password string) error {
+	return store.updateOne("users", bson.M{"username": username, "pc_key": pcKey}, bson.M{"password": password})
+}
+
+func (store *MongoStore) SetUserPermissions(username, pcKey string, permissions Json) error {
+	return store.updateOne("users", bson.M{"username": username, "pc_key": pcKey}, bson.M{"permissions": permissions})
+}
+
+func (store *MongoStore) SetUserObserverOnly(username, pcKey string, observerOnly bool) error {
+	return store.updateOne("users", bson.M{"username": username, "pc_key": pcKey}, bson.M{"observer_only": observerOnly})
+}
+
+func (store *MongoStore) SetUserAccess(username, pcKey string, access *UserAccess) error {
+	return store.updateOne("users", bson.M{"username": username, "pc_key": pcKey}, bson.M{"access": access})
+}
+
+func (store *MongoStore) SetUserRoles(username, pcKey string, roles []string) error {
+	return store.updateOne("users", bson.M{"username": username, "pc_key": pcKey}, bson.M{"roles": roles})
+}
+
+func (store *MongoStore) DeleteUser(username, pcKey string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := store.db.Collection("users").DeleteOne(ctx, bson.M{"username": username, "pc_key": pcKey})
+	if err != nil {
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (store *MongoStore) FindRole(name string) (*RoleRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result := store.db.Collection("roles").FindOne(ctx, bson.M{"name": name})
+	if result.Err() != nil {
+		return nil, mongoError(result.Err())
+	}
+
+	role := &RoleRecord{}
+	if err := result.Decode(role); err != nil {
+		return nil, err
+	}
+
+	permissions, err := bsonToJson(role.Permissions)
+	if err != nil {
+		return nil, err
+	}
+	role.Permissions = permissions
+
+	return role, nil
+}
+
+func (store *MongoStore) InsertRole(role *RoleRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := store.db.Collection("roles").InsertOne(ctx, role)
+	return err
+}
+
+func (store *MongoStore) SetRolePermissions(name string, permissions Json) error {
+	return store.updateOne("roles", bson.M{"name": name}, bson.M{"permissions": permissions})
+}
+
+// updateOne sets the fields of the document matching filter
+func (store *MongoStore) updateOne(collection string, filter, fields bson.M) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := store.db.Collection(collection).UpdateOne(ctx, filter, bson.M{"$set": fields})
+
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (store *MongoStore) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return store.client.Disconnect(ctx)
+}
+
+func mongoError(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
+
+/*
+bsonToJson converts a decoded document to plain Json
+
+Nested documents and arrays come out of the driver as bson types,
+this makes them the same as the ones decoded from a http request body
+*/
+func bsonToJson(doc Json) (Json, error) {
+	if doc == nil {
+		return nil, nil
+	}
+
+	data, err := bson.MarshalExtJSON(doc, false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonDoc := make(Json)
+	err = json.Unmarshal(data, &jsonDoc)
+	return jsonDoc, err
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// hashPassword returns a salted bcrypt hash of the password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// isPasswordHash checks if a stored password is already a bcrypt hash
+func isPasswordHash(storedPassword string) bool {
+	return strings.HasPrefix(storedPassword, "$2a$") ||
+		strings.HasPrefix(storedPassword, "$2b$") ||
+		strings.HasPrefix(storedPassword, "$2y$")
+}
+
+/*
+checkPassword compares a password with the stored one
+
+Records created before passwords were hashed still have them in plaintext,
+in that case upgrade is true and the caller should store a new hash
+*/
+func checkPassword(storedPassword, password string) (valid bool, upgrade bool) {
+	if isPasswordHash(storedPassword) {
+		return bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(password)) == nil, false
+	}
+
+	valid = subtle.ConstantTimeCompare([]byte(storedPassword), []byte(password)) == 1
+	return valid, valid
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := hashPassword("passwd")
+	assert.Nil(t, err)
+	assert.True(t, isPasswordHash(hash))
+	assert.NotContains(t, hash, "passwd")
+
+	otherHash, err := hashPassword("passwd")
+	assert.Nil(t, err)
+	assert.NotEqual(t, hash, otherHash, "each hash must have its own salt")
+
+	tests := []struct {
+		name           string
+		storedPassword string
+		password       string
+		valid          bool
+		upgrade        bool
+	}{
+		{"hash", hash, "passwd", true, false},
+		{"hashWrongPassword", hash, "wrong", false, false},
+		{"plaintext", "passwd", "passwd", true, true},
+		{"plaintextWrongPassword", "passwd", "wrong", false, false},
+		{"emptyPassword", hash, "", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			valid, upgrade := checkPassword(test.storedPassword, test.password)
+			assert.Equal(t, test.valid, valid)
+			assert.Equal(t, test.upgrade, upgrade)
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+/*
+pathPattern - path of a restriction, compared by component
+
+Components can be globs (*, ?, [a-z], see path.Match), ** matches any number of components.
+Patterns that don't start with / match anywhere, *.key is the same as **\/*.key
+*/
+type pathPattern struct {
+	components []string
+	score      int // literal components count more than globs, ** doesn't count
+}
+
+var errEmptyPattern = errors.New("empty path")
+
+func compilePathPattern(pattern string) (pathPattern, error) {
+	if len(strings.TrimSpace(pattern)) == 0 {
+		return pathPattern{}, errEmptyPattern
+	}
+
+	components := pathComponents(pattern)
+	if components[0] != "" {
+		components = append([]string{"**"}, components...)
+	}
+
+	compiled := pathPattern{components: components}
+	for _, component := range components {
+		switch {
+		case component == "**":
+		case isGlob(component):
+			if _, err := path.Match(component, ""); err != nil {
+				return pathPattern{}, fmt.Errorf("invalid pattern %q", component)
+			}
+			compiled.score++
+		default:
+			compiled.score += 2
+		}
+	}
+
+	return compiled, nil
+}
+
+func isGlob(component string) bool {
+	return strings.ContainsAny(component, `*?[\`)
+}
+
+/*
+matchPrefix returns the length of the shortest prefix of requested matched by the pattern,
+-1 if there is none. Anything after the prefix is under a matched path
+*/
+func (pattern pathPattern) matchPrefix(requested []string) int {
+	for length := 0; length <= len(requested); length++ {
+		if matchComponents(pattern.components, requested[:length]) {
+			return length
+		}
+	}
+	return -1
+}
+
+func matchComponents(pattern, requested []string) bool {
+	if len(pattern) == 0 {
+		return len(requested) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(requested); i++ {
+			if matchComponents(pattern[1:], requested[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(requested) == 0 {
+		return false
+	}
+
+	// the empty component is the root of absolute paths, only matched by the root itself
+	if (pattern[0] == "") != (requested[0] == "") {
+		return false
+	}
+
+	matched, _ := path.Match(pattern[0], requested[0])
+	return matched && matchComponents(pattern[1:], requested[1:])
+}
+
+var pathVariableRegex = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+/*
+pathVariable - value of a variable that can be used in restrictions, as a pattern
+
+component is the user data in the value, it must be a single path component:
+a username like ".." or "a/b" would point the pattern outside the directory it names
+*/
+type pathVariable struct {
+	value     string
+	component string
+}
+
+// pathVariables - the variables that can be used in restrictions, for the user on a PC with the flavor
+func pathVariables(username string, flavor pathFlavor) map[string]pathVariable {
+	escaped := escapeGlob(username)
+	if flavor == windowsPaths {
+		escaped = escapeWindowsGlob(username)
+	}
+	return map[string]pathVariable{
+		"username": {escaped, username},
+		"home":     {flavor.home(username), username},
+	}
+}
+
+// isPathComponent returns true if value names a single file or directory, on any PC
+func isPathComponent(value string) bool {
+	return len(value) > 0 && value != "." && value != ".." && !strings.ContainsAny(value, `/\`)
+}
+
+// expandPathVariables replaces ${name} with its value, unknown variables and values that aren't a single component are an error
+func expandPathVariables(pattern string, variables map[string]pathVariable) (string, error) {
+	var unknown, unsafe []string
+	expanded := pathVariableRegex.ReplaceAllStringFunc(pattern, func(variable string) string {
+		name := pathVariableRegex.FindStringSubmatch(variable)[1]
+		value, found := variables[name]
+		if !found {
+			unknown = append(unknown, variable)
+		} else if !isPathComponent(value.component) {
+			unsafe = append(unsafe, variable)
+		}
+		return value.value
+	})
+
+	if len(unknown) > 0 {
+		return pattern, fmt.Errorf("unknown variable %s", strings.Join(unknown, ", "))
+	}
+	if len(unsafe) > 0 {
+		return pattern, fmt.Errorf("variable %s is not a single path component", strings.Join(unsafe, ", "))
+	}
+	return expanded, nil
+}
+
+// escapeGlob makes value match only itself in a pattern
+func escapeGlob(value string) string {
+	var escaped strings.Builder
+	for _, char := range value {
+		if strings.ContainsRune(`*?[]\`, char) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(char)
+	}
+	return escaped.String()
+}
+
+// escapeWindowsGlob is escapeGlob for Windows patterns, where \ is a separator: the characters go in a class
+func escapeWindowsGlob(value string) string {
+	var escaped strings.Builder
+	for _, char := range value {
+		if strings.ContainsRune(`*?[`, char) {
+			escaped.WriteString("[" + string(char) + "]")
+			continue
+		}
+		escaped.WriteRune(char)
+	}
+	return escaped.String()
+}
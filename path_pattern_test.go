@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		matched int // prefix length, -1 if it doesn't match
+	}{
+		{"/home/test", "/home/test", 3},
+		{"/home/test", "/home/test/dir/file", 3},
+		{"/home/test/", "/home/test/dir", 3},
+		{"/home/test", "/home/testing", -1},
+		{"/home/test", "/home", -1},
+		{"/home/test", "home/test", -1},
+		{"/", "/etc/passwd", 1},
+
+		{"/home/*", "/home/alice/file", 3},
+		{"/home/*/Documents", "/home/alice/Documents/report.pdf", 4},
+		{"/home/*/Documents", "/home/alice/Downloads/report.pdf", -1},
+		{"/home/*/Documents/**", "/home/alice/Documents", 4},
+		{"/home/*/Documents/**", "/home/alice/Documents/a/b", 4},
+		{"/home/**/.ssh", "/home/alice/.ssh/id_rsa", 4},
+		{"/home/**/.ssh", "/home/alice/backup/.ssh/id_rsa", 5},
+		{"/home/alice?", "/home/alice2", 3},
+		{"/home/[a-c]*", "/home/bob", 3},
+		{"/home/[a-c]*", "/home/dave", -1},
+
+		// relative patterns match anywhere
+		{"*.key", "/etc/ssl/server.key", 4},
+		{"*.key", "/etc/ssl/server.pem", -1},
+		{"*.key", "/etc/keys.d/file", -1},
+		{".ssh", "/home/alice/.ssh/id_rsa", 4},
+		{"*", "/", -1},
+	}
+
+	for _, test := range tests {
+		pattern, err := compilePathPattern(test.pattern)
+		assert.Nil(t, err, test.pattern)
+		assert.Equal(t, test.matched, pattern.matchPrefix(pathComponents(test.path)), "%s %s", test.pattern, test.path)
+	}
+}
+
+func TestCompilePathPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		score   int
+		valid   bool
+	}{
+		{"/home/test", 6, true},
+		{"/home/*", 5, true},
+		{"/home/**/.ssh", 6, true},
+		{"*.key", 1, true},
+		{"/home/[a-", 0, false},
+		{"  ", 0, false},
+	}
+
+	for _, test := range tests {
+		pattern, err := compilePathPattern(test.pattern)
+		assert.Equal(t, test.valid, err == nil, test.pattern)
+		assert.Equal(t, test.score, pattern.score, test.pattern)
+	}
+}
+
+func TestExpandPathVariables(t *testing.T) {
+	tests := []struct {
+		username string
+		pattern  string
+		expanded string
+		valid    bool
+	}{
+		{"alice", "${home}/Documents", "/home/alice/Documents", true},
+		{"alice", "/srv/shared/${username}/**", "/srv/shared/alice/**", true},
+		{"alice", "/home/${user}", "/home/${user}", false},
+		{"alice", "/home/$username", "/home/$username", true},
+		{"a*b", "${home}", `/home/a\*b`, true},
+		{"..", "/home/${username}", "/home/${username}", false},
+		{".", "${home}/**", "${home}/**", false},
+		{"alice/../bob", "${home}", "${home}", false},
+		{`alice\..\bob`, "/srv/${username}", "/srv/${username}", false},
+		{"", "${home}", "${home}", false},
+		{"..", "/srv/shared", "/srv/shared", true},
+	}
+
+	for _, test := range tests {
+		expanded, err := expandPathVariables(test.pattern, pathVariables(test.username, posixPaths))
+		assert.Equal(t, test.valid, err == nil, test.pattern)
+		assert.Equal(t, test.expanded, expanded, test.pattern)
+	}
+
+	// on Windows \ is a separator, glob characters are escaped in a class
+	expanded, err := expandPathVariables(`${home}\Documents`, pathVariables("a*b", windowsPaths))
+	assert.Nil(t, err)
+	assert.Equal(t, `C:\Users\a[*]b\Documents`, expanded)
+
+	// usernames with glob characters only match themselves
+	pattern, err := compilePathPattern(`/home/a\*b`)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, pattern.matchPrefix(pathComponents("/home/a*b/file")))
+	assert.Equal(t, -1, pattern.matchPrefix(pathComponents("/home/axb/file")))
+}
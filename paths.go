@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	errInvalidPath = errors.New("invalid path")
+	errPathEscapes = errors.New("path escapes the root")
+	errPathType    = errors.New("path must be a string")
+)
+
+// pathRoot - paths are resolved against it, nothing can be above it
+const pathRoot = "/"
+
+/*
+pathFlavor - how the PC writes its paths, from the OS it declares in its hello
+
+Windows paths start with a drive (C:\), use \ or / as separator and are compared ignoring case.
+The zero value is posix
+*/
+type pathFlavor string
+
+const (
+	posixPaths   pathFlavor = "posix"
+	windowsPaths pathFlavor = "windows"
+)
+
+var windowsDrive = regexp.MustCompile(`^[A-Za-z]:([\\/]|$)`)
+
+func parsePathFlavor(os string) (pathFlavor, error) {
+	switch strings.ToLower(os) {
+	case "", "posix", "linux", "darwin", "freebsd":
+		return posixPaths, nil
+	case "windows":
+		return windowsPaths, nil
+	}
+	return "", fmt.Errorf("unknown OS %q", os)
+}
+
+/*
+canonicalPath resolves a path lexically against the root
+
+. and empty components are dropped and .. removes the previous component,
+a .. that would go above the root is an error instead of being dropped.
+Relative paths are taken from the root. Names are never rewritten, foo../bar stays as it is
+*/
+func canonicalPath(requested string) (string, error) {
+	if len(requested) == 0 || strings.ContainsRune(requested, 0) {
+		return "", errInvalidPath
+	}
+
+	components := make([]string, 0, strings.Count(requested, "/")+1)
+	for _, component := range strings.Split(requested, "/") {
+		switch component {
+		case "", ".":
+		case "..":
+			if len(components) == 0 {
+				return "", errPathEscapes
+			}
+			components = components[:len(components)-1]
+		default:
+			components = append(components, component)
+		}
+	}
+
+	return path.Join(pathRoot, strings.Join(components, "/")), nil
+}
+
+/*
+canonicalWindowsPath resolves a Windows path lexically against its drive, as canonicalPath does
+
+Only absolute paths are accepted. Windows ignores trailing dots and spaces of names
+and reads file:stream as file, names like that are rejected so a restricted path
+can't be written another way
+*/
+func canonicalWindowsPath(requested string) (string, error) {
+	if strings.ContainsRune(requested, 0) || !windowsDrive.MatchString(requested) {
+		return "", errInvalidPath
+	}
+
+	components := make([]string, 0, strings.Count(requested, `\`)+1)
+	for _, component := range strings.FieldsFunc(requested[2:], isWindowsSeparator) {
+		switch {
+		case component == ".":
+		case component == "..":
+			if len(components) == 0 {
+				return "", errPathEscapes
+			}
+			components = components[:len(components)-1]
+		case strings.ContainsRune(component, ':') || strings.HasSuffix(component, ".") || strings.HasSuffix(component, " "):
+			return "", errInvalidPath
+		default:
+			components = append(components, component)
+		}
+	}
+
+	return strings.ToUpper(requested[:1]) + `:\` + strings.Join(components, `\`), nil
+}
+
+func isWindowsSeparator(char rune) bool {
+	return char == '\\' || char == '/'
+}
+
+// canonical resolves a path written the flavor way, see canonicalPath and canonicalWindowsPath
+func (flavor pathFlavor) canonical(requested string) (string, error) {
+	if flavor == windowsPaths {
+		return canonicalWindowsPath(requested)
+	}
+	return canonicalPath(requested)
+}
+
+/*
+matchable returns a canonical path the way restriction patterns are matched against it
+
+Windows paths are lowercased and written with /, starting at the drive: C:\Users\Bob is /c:/users/bob
+*/
+func (flavor pathFlavor) matchable(canonical string) string {
+	if flavor != windowsPaths {
+		return canonical
+	}
+	return "/" + strings.ToLower(strings.ReplaceAll(canonical, `\`, "/"))
+}
+
+// matchablePattern converts a restriction pattern as matchable does with paths, \ is a separator on Windows
+func (flavor pathFlavor) matchablePattern(pattern string) string {
+	if flavor != windowsPaths {
+		return pattern
+	}
+
+	pattern = strings.ToLower(strings.ReplaceAll(pattern, `\`, "/"))
+	if windowsDrive.MatchString(pattern) {
+		return "/" + pattern
+	}
+	return pattern
+}
+
+// home returns the home directory of the user as a pattern
+func (flavor pathFlavor) home(username string) string {
+	if flavor == windowsPaths {
+		return `C:\Users\` + escapeWindowsGlob(username)
+	}
+	return "/home/" + escapeGlob(username)
+}
+
+// isPathArgument returns true if the argument at index is a path for the command, see commandRegistry.
+// Commands that are not registered have no paths
+func isPathArgument(cmd string, index int) bool {
+	spec, found := lookupCommand(cmd)
+	return found && index < len(spec.Args) && spec.Args[index].Kind == pathArg
+}
+
+/*
+canonicalArgs validates the args of a known command and returns a copy of them with
+the paths canonicalized, any invalid argument is an error.
+The args of commands that are not registered are returned as they are
+*/
+func canonicalArgs(flavor pathFlavor, cmd string, args []interface{}) ([]interface{}, error) {
+	spec, found := lookupCommand(cmd)
+	if !found {
+		return args, nil
+	}
+	if err := spec.validate(args); err != nil {
+		return nil, err
+	}
+
+	canonical := make([]interface{}, len(args))
+	for i, arg := range args {
+		canonical[i] = arg
+		if !isPathArgument(cmd, i) {
+			continue
+		}
+
+		var err error
+		if canonical[i], err = flavor.canonical(arg.(string)); err != nil {
+			return nil, err
+		}
+	}
+	return canonical, nil
+}
+
+// pathArgs returns the path arguments of the command
+func pathArgs(cmd string, args []interface{}) []string {
+	paths := make([]string, 0, len(args))
+	for i, arg := range args {
+		if requested, ok := arg.(string); ok && isPathArgument(cmd, i) {
+			paths = append(paths, requested)
+		}
+	}
+	return paths
+}
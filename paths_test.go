@@ -0,0 +1,239 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalPath(t *testing.T) {
+	tests := []struct {
+		requested string
+		canonical string
+		err       error
+	}{
+		{"/home/test", "/home/test", nil},
+		{"/home/test/", "/home/test", nil},
+		{"//home/./test//dir", "/home/test/dir", nil},
+		{"/home/test/../other", "/home/other", nil},
+		{"home/test", "/home/test", nil}, // relative to the root
+		{"/", "/", nil},
+		{".", "/", nil},
+		{"/home/..", "/", nil},
+		{"foo../bar", "/foo../bar", nil}, // names are not rewritten
+		{"/home/.../test", "/home/.../test", nil},
+		{"....//", "/....", nil},
+		{"/home/test/.hidden", "/home/test/.hidden", nil},
+
+		{"/..", "", errPathEscapes},
+		{"../etc/passwd", "", errPathEscapes},
+		{"/home/test/../../../etc", "", errPathEscapes},
+		{"", "", errInvalidPath},
+		{"/home/test\x00.txt", "", errInvalidPath},
+	}
+
+	for _, test := range tests {
+		canonical, err := canonicalPath(test.requested)
+		assert.Equal(t, test.err, err, test.requested)
+		assert.Equal(t, test.canonical, canonical, test.requested)
+	}
+}
+
+func TestCanonicalWindowsPath(t *testing.T) {
+	tests := []struct {
+		requested string
+		canonical string
+		err       error
+	}{
+		{`C:\Users\Bob`, `C:\Users\Bob`, nil},
+		{`c:/Users/Bob/`, `C:\Users\Bob`, nil},
+		{`C:\Users\\.\Bob\..\Alice`, `C:\Users\Alice`, nil},
+		{`d:\`, `D:\`, nil},
+		{`D:`, `D:\`, nil},
+		{`C:\Users\Bob\..\..`, `C:\`, nil},
+
+		{`C:\..\Windows`, "", errPathEscapes},
+		{`Users\Bob`, "", errInvalidPath},      // relative
+		{`\Users\Bob`, "", errInvalidPath},     // relative to the current drive
+		{`\\server\share`, "", errInvalidPath}, // UNC
+		{`C:Users`, "", errInvalidPath},
+		{`C:\Users\Bob\file.txt:secret`, "", errInvalidPath}, // alternate data stream
+		{`C:\Windows.\System32`, "", errInvalidPath},         // trailing dot, same as C:\Windows
+		{`C:\Windows \System32`, "", errInvalidPath},
+		{"C:\\file\x00.txt", "", errInvalidPath},
+		{"", "", errInvalidPath},
+	}
+
+	for _, test := range tests {
+		canonical, err := windowsPaths.canonical(test.requested)
+		assert.Equal(t, test.err, err, test.requested)
+		assert.Equal(t, test.canonical, canonical, test.requested)
+	}
+
+	_, err := parsePathFlavor("plan9")
+	assert.NotNil(t, err)
+	flavor, err := parsePathFlavor("Windows")
+	assert.Nil(t, err)
+	assert.Equal(t, windowsPaths, flavor)
+}
+
+func TestWindowsPermissions(t *testing.T) {
+	permissions := decodePermissions("Bob", windowsPaths, Json{"commands": Json{
+		"download_file": Json{"allow": true, "restrictions": []interface{}{
+			Json{"path": `C:\Windows`, "allow": false},
+			Json{"path": "${home}", "allow": false, "allow_subdir": false},
+			Json{"path": "${home}/Public", "allow": true},
+		}},
+		"ls_dir": Json{"allow": false, "restrictions": []interface{}{Json{"path": `d:/Data/*`, "allow": true}}},
+	}})
+
+	tests := []struct {
+		cmd   string
+		path  string
+		allow bool
+	}{
+		{"download_file", `c:/windows/System32/config/SAM`, false}, // case is ignored
+		{"download_file", `C:\WINDOWS\win.ini`, false},
+		{"download_file", `C:\Windows.old\file`, true},
+		{"download_file", `C:\Users\bob\secret.txt`, false},
+		{"download_file", `C:\USERS\BOB\PUBLIC\a.txt`, true},
+		{"download_file", `D:\Windows\file`, true}, // other drive
+		{"ls_dir", `D:\data\logs`, true},
+		{"ls_dir", `C:\data\logs`, false},
+	}
+
+	for _, test := range tests {
+		path, err := windowsPaths.canonical(test.path)
+		assert.Nil(t, err, test.path)
+		request := permissionRequest{cmd: test.cmd, args: []interface{}{path}, paths: windowsPaths}
+		assert.Equal(t, test.allow, permissions.allows(request), "%s %s", test.cmd, test.path)
+	}
+
+	// posix patterns are still valid, Windows ones can use \ as separator
+	assert.Nil(t, validatePathPattern(`C:\Users\${username}\*`))
+	assert.Nil(t, validatePathPattern(`/home/${username}/\*`))
+}
+
+func TestCanonicalArgs(t *testing.T) {
+	args, err := canonicalArgs(posixPaths, "rename_file", []interface{}{"/tmp/a/../b", "docs/./c"})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"/tmp/b", "/docs/c"}, args)
+
+	// only the declared arguments are paths
+	args, err = canonicalArgs(posixPaths, "upload_file", []interface{}{"/home/test/", true})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"/home/test", true}, args)
+
+	// the args of a command that is not registered are left as they are
+	args, err = canonicalArgs(posixPaths, "sync_files", []interface{}{"/tmp/a/", 10, "echo hi", "../.."})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"/tmp/a/", 10, "echo hi", "../.."}, args)
+
+	_, err = canonicalArgs(posixPaths, "delete_file", []interface{}{10})
+	assert.Equal(t, errPathType, err)
+
+	_, err = canonicalArgs(posixPaths, "copy_file", []interface{}{"/tmp/a", "../../b"})
+	assert.Equal(t, errPathEscapes, err)
+
+	args, err = canonicalArgs(windowsPaths, "rename_file", []interface{}{`c:\tmp\a\..\b`, "D:/docs/c"})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{`C:\tmp\b`, `D:\docs\c`}, args)
+}
+
+/*
+FuzzCanonicalPath checks that a restriction can't be bypassed by how the path is written
+
+Accepted paths are absolute, clean and the same the PC resolves them to,
+so a path is denied exactly when it is inside the restricted directory
+*/
+func FuzzCanonicalPath(f *testing.F) {
+	seeds := []string{
+		"/home/secret", "/home/secret/key", "/home/secretary/key", "home/secret/key",
+		"/home/secret/../secret/key", "/home/./secret/key", "//home//secret//key", "/home/public/../secret",
+		"/home/secret/..", "/home/a/b/../../secret", "/home/secret\x00/key", "/home/secret/./", "....//",
+		"foo../bar", "/..", "../home/secret", "/home/secret/../../..", ".", "", "/home/secret/.../key",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	rule := CommandRule{Allow: true, Restrictions: []PathRestriction{{Path: "/home/secret", Allow: false}}}
+
+	f.Fuzz(func(t *testing.T, requested string) {
+		canonical, err := canonicalPath(requested)
+		if err != nil {
+			if err == errInvalidPath && len(requested) > 0 && !strings.ContainsRune(requested, 0) {
+				t.Fatalf("%q rejected as invalid", requested)
+			}
+			return
+		}
+
+		if canonical != path.Clean("/"+requested) {
+			t.Fatalf("%q canonicalized to %q, the PC resolves it to %q", requested, canonical, path.Clean("/"+requested))
+		}
+		for _, component := range strings.Split(canonical, "/") {
+			if component == "." || component == ".." {
+				t.Fatalf("%q canonicalized to %q", requested, canonical)
+			}
+		}
+
+		inside := canonical == "/home/secret" || strings.HasPrefix(canonical, "/home/secret/")
+		for _, file := range []bool{true, false} {
+			if allow, _ := rule.allowsPath(canonical, file, posixPaths); allow == inside {
+				t.Fatalf("%q (%q) allowed: %v", requested, canonical, allow)
+			}
+		}
+	})
+}
+
+func FuzzCanonicalWindowsPath(f *testing.F) {
+	seeds := []string{
+		`C:\Windows\System32`, `c:/windows/system32`, `C:\WINDOWS\..\Windows\win.ini`, `C:/Windows\System32/./config`,
+		`C:`, `C:\`, `D:\Windows\file`, `C:\..\Windows`, `C:\Windows\..\..`, `C:Windows`, `1:\Windows`,
+		`C:\Windows\win.ini:stream`, `C:\Windows::$DATA`, `C:\Windows.\System32`, `C:\Windows \System32`, `C:\Windows...`,
+		`\\server\share\Windows`, `\\?\C:\Windows`, `\\.\C:\Windows`, `//server/share`, `\Windows`, "C:\\Win\x00dows", "",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	permissions := decodePermissions("Bob", windowsPaths, Json{"commands": Json{
+		"download_file": Json{"allow": true, "restrictions": []interface{}{Json{"path": `C:\Windows`, "allow": false}}},
+	}})
+
+	f.Fuzz(func(t *testing.T, requested string) {
+		canonical, err := canonicalWindowsPath(requested)
+		if err != nil {
+			return
+		}
+
+		again, err := canonicalWindowsPath(canonical)
+		if err != nil || again != canonical {
+			t.Fatalf("%q canonicalized to %q, then to %q (%v)", requested, canonical, again, err)
+		}
+		matchable := windowsPaths.matchable(canonical)
+		if windowsPaths.matchable(again) != matchable {
+			t.Fatalf("%q matched as %q and %q", requested, matchable, windowsPaths.matchable(again))
+		}
+
+		// under the drive of the request, without components Windows would read another way
+		root := "/" + strings.ToLower(requested[:1]) + ":/"
+		if !strings.HasPrefix(matchable+"/", root) {
+			t.Fatalf("%q (%q) is not under %q", requested, matchable, root)
+		}
+		for _, component := range strings.Split(strings.TrimPrefix(matchable, root), "/") {
+			if component == "." || component == ".." || strings.ContainsRune(component, ':') ||
+				strings.HasSuffix(component, ".") || strings.HasSuffix(component, " ") {
+				t.Fatalf("%q matched as %q", requested, matchable)
+			}
+		}
+
+		inside := matchable == "/c:/windows" || strings.HasPrefix(matchable, "/c:/windows/")
+		request := permissionRequest{cmd: "download_file", args: []interface{}{canonical}, paths: windowsPaths}
+		if permissions.allows(request) == inside {
+			t.Fatalf("%q (%q) allowed: %v", requested, canonical, !inside)
+		}
+	})
+}
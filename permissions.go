@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+)
+
+// PathRestriction - allows or denies a command on a path
+type PathRestriction struct {
+	Path        string `json:"path"`
+	Allow       bool   `json:"allow"`
+	AllowSubdir *bool  `json:"allow_subdir,omitempty"` // not set: subdirectories follow Allow
+}
+
+// CommandRule - whether a command can be used, restrictions take precedence for the paths they match
+// (see CommandRule.allowsPath)
+type CommandRule struct {
+	Allow        bool              `json:"allow"`
+	Restrictions []PathRestriction `json:"restrictions,omitempty"`
+	Condition    string            `json:"condition,omitempty"` // must also be true for the command to be allowed
+
+	condition cel.Program
+}
+
+/*
+Permissions - what a user can do on the PC
+
+Registered commands that are not listed are allowed, the ones that are not
+registered (see commandRegistry) must be listed to be allowed
+*/
+type Permissions struct {
+	Commands map[string]CommandRule `json:"commands"`
+
+	denyAll bool // the stored document couldn't be read
+}
+
+// FieldError - a problem with a single field of a permissions document
+type FieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// PermissionsError - every problem found in a permissions document
+type PermissionsError []FieldError
+
+func (permErr PermissionsError) Error() string {
+	problems := make([]string, len(permErr))
+	for i, fieldErr := range permErr {
+		problems[i] = fieldErr.Field + ": " + fieldErr.Error
+	}
+	return "invalid permissions: " + strings.Join(problems, ", ")
+}
+
+type fieldErrors []FieldError
+
+func (errs *fieldErrors) add(field, format string, args ...interface{}) {
+	*errs = append(*errs, FieldError{field, fmt.Sprintf(format, args...)})
+}
+
+// unknownKeys reports keys that are not in known, sorted so errors are always in the same order
+func (errs *fieldErrors) unknownKeys(field string, data Json, known ...string) {
+	for _, key := range sortedKeys(data) {
+		found := false
+		for _, knownKey := range known {
+			found = found || key == knownKey
+		}
+		if !found {
+			errs.add(field+key, "unknown field")
+		}
+	}
+}
+
+/*
+ParsePermissions validates a permissions document, as sent to set_user_permissions
+
+Unknown fields and wrong types are errors, every problem is returned
+*/
+func ParsePermissions(data Json) (Permissions, PermissionsError) {
+	permissions := Permissions{Commands: make(map[string]CommandRule)}
+	var errs fieldErrors
+
+	errs.unknownKeys("", data, "commands")
+
+	if value, found := data["commands"]; found {
+		commands, ok := value.(Json)
+		if !ok {
+			errs.add("commands", "must be an object")
+		}
+
+		for _, name := range sortedKeys(commands) {
+			rule, ruleErrs := parseCommandRule(name, commands[name])
+			errs = append(errs, ruleErrs...)
+			permissions.Commands[name] = rule
+		}
+	}
+
+	if len(errs) > 0 {
+		return permissions, PermissionsError(errs)
+	}
+	return permissions, nil
+}
+
+// parseCommandRule validates the rule of the command, restrictions are only checked on registered commands with paths
+func parseCommandRule(name string, value interface{}) (CommandRule, fieldErrors) {
+	var rule CommandRule
+	var errs fieldErrors
+	field := "commands." + name
+
+	data, ok := value.(Json)
+	if !ok {
+		errs.add(field, "must be an object")
+		return rule, errs
+	}
+	errs.unknownKeys(field+".", data, "allow", "restrictions", "condition")
+
+	if rule.Allow, ok = data["allow"].(bool); !ok {
+		errs.add(field+".allow", "required, must be a boolean")
+	}
+
+	if value, found := data["restrictions"]; found {
+		restrictions, ok := value.([]interface{})
+		if !ok {
+			errs.add(field+".restrictions", "must be an array")
+		} else if spec, found := lookupCommand(name); !found || !spec.hasPathArgs() {
+			errs.add(field+".restrictions", "restrictions need a registered command with a path argument")
+		}
+
+		for i, value := range restrictions {
+			restriction, restrictionErrs := parsePathRestriction(fmt.Sprintf("%s.restrictions[%d]", field, i), value)
+			errs = append(errs, restrictionErrs...)
+			rule.Restrictions = append(rule.Restrictions, restriction)
+		}
+	}
+
+	if value, found := data["condition"]; found {
+		var err error
+		if rule.Condition, ok = value.(string); !ok {
+			errs.add(field+".condition", "must be a string")
+		} else if rule.condition, err = compileCondition(rule.Condition); err != nil {
+			errs.add(field+".condition", "%s", err.Error())
+		}
+	}
+
+	return rule, errs
+}
+
+func parsePathRestriction(field string, value interface{}) (PathRestriction, fieldErrors) {
+	var restriction PathRestriction
+	var errs fieldErrors
+
+	data, ok := value.(Json)
+	if !ok {
+		errs.add(field, "must be an object")
+		return restriction, errs
+	}
+	errs.unknownKeys(field+".", data, "path", "allow", "allow_subdir")
+
+	if restriction.Path, ok = data["path"].(string); !ok || len(strings.TrimSpace(restriction.Path)) == 0 {
+		errs.add(field+".path", "required, must be a non-empty string")
+	} else if err := validatePathPattern(restriction.Path); err != nil {
+		errs.add(field+".path", "%s", err.Error())
+	}
+
+	if restriction.Allow, ok = data["allow"].(bool); !ok {
+		errs.add(field+".allow", "required, must be a boolean")
+	}
+
+	if value, found := data["allow_subdir"]; found {
+		allowSubdir, ok := value.(bool)
+		if !ok {
+			errs.add(field+".allow_subdir", "must be a boolean")
+		}
+		restriction.AllowSubdir = &allowSubdir
+	}
+
+	return restriction, errs
+}
+
+/*
+decodePermissions reads permissions stored by any version, it never fails
+
+Documents stored before validation existed may be malformed, a command
+whose rule can't be read is denied instead of being left out (which would allow it)
+*/
+func decodePermissions(username string, flavor pathFlavor, data Json) Permissions {
+	permissions := Permissions{Commands: make(map[string]CommandRule)}
+
+	commands, ok := data["commands"].(Json)
+	if !ok {
+		if _, found := data["commands"]; found {
+			log.Printf("Invalid permissions for user '%s', denying every command", username)
+			permissions.denyAll = true
+		}
+		return permissions
+	}
+
+	variables := pathVariables(username, flavor)
+	for name, value := range commands {
+		rule, errs := parseCommandRule(name, value)
+		if len(errs) > 0 {
+			log.Printf("Invalid permissions for user '%s', denying command '%s'. Error: %s", username, name, PermissionsError(errs).Error())
+			rule = CommandRule{Allow: false}
+		}
+
+		for i := range rule.Restrictions {
+			// already validated, the variables are known but the username may not fit in a path
+			path, err := expandPathVariables(rule.Restrictions[i].Path, variables)
+			if err != nil {
+				log.Printf("Invalid permissions for user '%s', denying command '%s'. Error: %s", username, name, err.Error())
+				rule = CommandRule{Allow: false}
+				break
+			}
+			rule.Restrictions[i].Path = path
+		}
+		permissions.Commands[name] = rule
+	}
+
+	return permissions
+}
+
+// rule returns the rule for cmd, false if the command isn't restricted
+func (permissions Permissions) rule(cmd string) (CommandRule, bool) {
+	if permissions.denyAll {
+		return CommandRule{Allow: false}, true
+	}
+	rule, found := permissions.Commands[cmd]
+	return rule, found
+}
+
+// validatePathPattern checks the variables and globs of a restriction path, patterns starting with a drive are Windows ones
+func validatePathPattern(pattern string) error {
+	flavor := posixPaths
+	if windowsDrive.MatchString(pattern) {
+		flavor = windowsPaths
+	}
+
+	expanded, err := expandPathVariables(pattern, pathVariables("username", flavor))
+	if err != nil {
+		return err
+	}
+	_, err = compilePathPattern(flavor.matchablePattern(expanded))
+	return err
+}
+
+// permissionDecision - whether a command is allowed and why
+type permissionDecision struct {
+	Allow  bool           `json:"allow"`
+	Source string         `json:"source,omitempty"` // user or role:<name>, empty if no rule exists for the command
+	Reason string         `json:"reason"`
+	Rule   *CommandRule   `json:"rule,omitempty"`
+	Paths  []pathDecision `json:"paths,omitempty"`
+}
+
+// pathDecision - how a path argument was checked, Restriction is the one that decided (nil if it was the rule allow)
+type pathDecision struct {
+	Path        string           `json:"path"`
+	Allow       bool             `json:"allow"`
+	Restriction *PathRestriction `json:"restriction,omitempty"`
+}
+
+func (permissions Permissions) allows(request permissionRequest) bool {
+	return permissions.decide(request).Allow
+}
+
+/*
+decide checks every path argument of the command (see commandRegistry), all of them must be allowed,
+then the condition of the rule
+
+Without any path the rule's allow decides
+*/
+func (permissions Permissions) decide(request permissionRequest) permissionDecision {
+	rule, found := permissions.rule(request.cmd)
+	if !found {
+		return unruledDecision(request.cmd)
+	}
+	if permissions.denyAll {
+		return permissionDecision{Allow: false, Reason: "Stored permissions are invalid, every command is denied"}
+	}
+
+	decision := permissionDecision{Rule: &rule}
+	for _, requestedPath := range pathArgs(request.cmd, request.args) {
+		allow, restriction := rule.allowsPath(request.paths.matchable(requestedPath), !isListingCommand(request.cmd), request.paths)
+		decision.Paths = append(decision.Paths, pathDecision{requestedPath, allow, restriction})
+		if !allow {
+			log.Printf("Command '%s' not allowed on %s", request.cmd, requestedPath)
+			decision.Reason = fmt.Sprintf("Not allowed on %s", requestedPath)
+			return decision
+		}
+	}
+
+	if len(decision.Paths) == 0 && !rule.Allow {
+		decision.Reason = "Command is not allowed"
+		return decision
+	}
+
+	if rule.condition != nil && !evalCondition(rule.condition, request) {
+		log.Printf("Condition of command '%s' not met: %s", request.cmd, rule.Condition)
+		decision.Reason = fmt.Sprintf("Condition not met: %s", rule.Condition)
+		return decision
+	}
+
+	decision.Allow, decision.Reason = true, "Allowed"
+	return decision
+}
+
+// unruledDecision - the decision for a command without rules, commands that are not registered must be allowed explicitly
+func unruledDecision(cmd string) permissionDecision {
+	if _, found := lookupCommand(cmd); !found {
+		return permissionDecision{Allow: false, Reason: "Command is not registered, it must be allowed explicitly"}
+	}
+	return permissionDecision{Allow: true, Reason: "Command is not restricted"}
+}
+
+/*
+allowsPath - the most specific restriction that matches the path decides (and is returned),
+rule.Allow is used if none does
+
+Paths are compared by component, /home/test matches /home/test/dir but not /home/testing.
+A restriction applies its allow to the path itself (and to the files directly in it,
+for file commands) and allow_subdir (or allow if not set) to anything deeper.
+
+The restriction that matches the longest part of the path is the most specific,
+then the one with more literal components (/home/test over /home/*).
+When restrictions are equally specific, a deny wins.
+requestedPath must be matchable (see pathFlavor.matchable), the restrictions are converted with the flavor
+*/
+func (rule CommandRule) allowsPath(requestedPath string, file bool, flavor pathFlavor) (bool, *PathRestriction) {
+	requested := pathComponents(requestedPath)
+	allow, best := rule.Allow, [2]int{-1, -1}
+	var decidedBy *PathRestriction
+
+	itself := 0
+	if file {
+		itself = 1
+	}
+
+	for i, restriction := range rule.Restrictions {
+		pattern, err := compilePathPattern(flavor.matchablePattern(restriction.Path))
+		if err != nil {
+			continue
+		}
+
+		matched := pattern.matchPrefix(requested)
+		if matched < 0 {
+			continue
+		}
+
+		decision := restriction.Allow
+		if len(requested)-matched > itself {
+			decision = restriction.allowsSubdirs()
+		}
+
+		specificity := [2]int{matched, pattern.score}
+		switch {
+		case specificity[0] > best[0] || (specificity[0] == best[0] && specificity[1] > best[1]):
+			allow, best, decidedBy = decision, specificity, &rule.Restrictions[i]
+		case specificity == best && !decision:
+			allow, decidedBy = false, &rule.Restrictions[i]
+		}
+	}
+
+	return allow, decidedBy
+}
+
+func (restriction PathRestriction) allowsSubdirs() bool {
+	if restriction.AllowSubdir == nil {
+		return restriction.Allow
+	}
+	return *restriction.AllowSubdir
+}
+
+// pathComponents splits a cleaned path, absolute paths start with an empty component
+func pathComponents(requestedPath string) []string {
+	cleaned := path.Clean(requestedPath)
+	if cleaned == "/" {
+		return []string{""}
+	}
+	return strings.Split(cleaned, "/")
+}
+
+func sortedKeys(data Json) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func loadPermissionsFile(t *testing.T) Json {
+	data, err := ioutil.ReadFile("permissions.json")
+	assert.Nil(t, err)
+
+	userData := make(Json)
+	assert.Nil(t, json.Unmarshal(data, &userData))
+	return userData["permissions"].(Json)
+}
+
+func TestParsePermissions(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		permissions, err := ParsePermissions(loadPermissionsFile(t))
+		assert.Nil(t, err)
+		assert.Len(t, permissions.Commands, 3)
+
+		download := permissions.Commands["download_file"]
+		assert.True(t, download.Allow)
+		assert.Equal(t, "/home/test", download.Restrictions[0].Path)
+		assert.True(t, *download.Restrictions[0].AllowSubdir)
+		assert.Nil(t, permissions.Commands["ls_dir"].Restrictions[0].AllowSubdir)
+
+		_, err = ParsePermissions(Json{})
+		assert.Nil(t, err)
+	})
+
+	t.Run("EveryFieldErrorIsReported", func(t *testing.T) {
+		_, err := ParsePermissions(Json{
+			"commands": Json{
+				"ls_dir": Json{"allow": "yes"},
+				"delete_file": Json{
+					"allow": false,
+					"restrictions": []interface{}{
+						Json{"path": "", "allow": true, "allow_subdir": 1},
+						"/home",
+						Json{"path": "/tmp", "allow": true, "recursive": true},
+					},
+				},
+				"download_file": []interface{}{},
+			},
+			"roles": []interface{}{},
+		})
+
+		assert.Equal(t, PermissionsError{
+			{"roles", "unknown field"},
+			{"commands.delete_file.restrictions[0].path", "required, must be a non-empty string"},
+			{"commands.delete_file.restrictions[0].allow_subdir", "must be a boolean"},
+			{"commands.delete_file.restrictions[1]", "must be an object"},
+			{"commands.delete_file.restrictions[2].recursive", "unknown field"},
+			{"commands.download_file", "must be an object"},
+			{"commands.ls_dir.allow", "required, must be a boolean"},
+		}, err)
+
+		_, err = ParsePermissions(Json{"commands": "all"})
+		assert.Equal(t, PermissionsError{{"commands", "must be an object"}}, err)
+	})
+
+	t.Run("RestrictionsNeedPaths", func(t *testing.T) {
+		// the server doesn't know which args of these commands are paths, the restrictions would never apply
+		restricted := Json{"allow": true, "restrictions": []interface{}{Json{"path": "/etc", "allow": false}}}
+		_, err := ParsePermissions(Json{"commands": Json{"custom_cmd": restricted, "kill_process": restricted, "delete_file": restricted}})
+		assert.Equal(t, PermissionsError{
+			{"commands.custom_cmd.restrictions", "restrictions need a registered command with a path argument"},
+			{"commands.kill_process.restrictions", "restrictions need a registered command with a path argument"},
+		}, err)
+
+		_, err = ParsePermissions(Json{"commands": Json{"custom_cmd": Json{"allow": true}}})
+		assert.Nil(t, err)
+
+		// stored before they were rejected, the command is denied
+		user := NewUser(&UserRecord{Username: "username", Permissions: Json{"commands": Json{"custom_cmd": restricted}}}, nil, false)
+		assert.False(t, user.havePermission("custom_cmd", []interface{}{"/etc/passwd"}))
+		assert.False(t, user.havePermission("custom_cmd", []interface{}{"/home/test"}))
+	})
+}
+
+func TestDecodePermissions(t *testing.T) {
+	permissions := decodePermissions("username", posixPaths, loadPermissionsFile(t))
+	assert.Len(t, permissions.Commands, 3)
+
+	// documents stored before validation existed
+	legacy := Json{
+		"commands": Json{
+			"ls_dir":        Json{"allow": true, "restrictions": []interface{}{Json{"path": 10, "allow": "no"}}},
+			"download_file": "allow",
+			"delete_file":   Json{"allow": true},
+		},
+	}
+
+	var user *User
+	assert.NotPanics(t, func() {
+		user = NewUser(&UserRecord{Username: "username", Permissions: legacy}, nil, false)
+	})
+	assert.False(t, user.havePermission("ls_dir", []interface{}{"/home"}))
+	assert.False(t, user.havePermission("download_file", []interface{}{"/home/file"}))
+	assert.True(t, user.havePermission("delete_file", []interface{}{"/home/file"}))
+	assert.True(t, user.havePermission("upload_file", []interface{}{"/home/file"}), "commands that are not listed are allowed")
+
+	user = NewUser(&UserRecord{Username: "username", Permissions: Json{"commands": []interface{}{}}}, nil, false)
+	assert.False(t, user.havePermission("upload_file", []interface{}{"/home/file"}), "unreadable permissions deny everything")
+
+	user = NewUser(&UserRecord{Username: "username"}, nil, false)
+	assert.True(t, user.havePermission("upload_file", []interface{}{"/home/file"}))
+
+	// usernames that don't fit in a path deny the rules that use them
+	template := Json{"commands": Json{"download_file": Json{"allow": false, "restrictions": []interface{}{
+		Json{"path": "${home}", "allow": true, "allow_subdir": true},
+	}}}}
+	for _, username := range []string{"..", ".", "alice/..", `alice\..`} {
+		user = NewUser(&UserRecord{Username: username, Permissions: template}, nil, false)
+		assert.False(t, user.havePermission("download_file", []interface{}{"/etc/shadow"}), username)
+		assert.False(t, user.havePermission("download_file", []interface{}{"/home/alice/file"}), username)
+	}
+}
+
+func TestSetUserPermissions(t *testing.T) {
+	store := NewMemoryStore()
+	if err := setup(store); err != nil {
+		panic(err.Error())
+	}
+
+	wsController := NewWsController("admin", "admin", store, "")
+	server := httptest.NewServer(wsController.routes())
+	defer server.Close()
+
+	adminHeader := http.Header{
+		"X-Username": []string{fmt.Sprintf("%x", sha256.Sum256([]byte("admin")))},
+		"X-Password": []string{fmt.Sprintf("%x", sha256.Sum256([]byte("admin")))},
+	}
+
+	resp, body := postJson(t, server.URL+"/set_user_permissions/"+key, adminHeader, Json{
+		"username":    "username",
+		"permissions": Json{"commands": Json{"ls_dir": Json{"allow": true, "restrictions": Json{}}}},
+	})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "Invalid permissions", body["error"])
+	assert.Equal(t, []interface{}{Json{"field": "commands.ls_dir.restrictions", "error": "must be an array"}}, body["fields"])
+
+	// invalid permissions are not stored
+	user, err := store.FindUser("username", key)
+	assert.Nil(t, err)
+	assert.Equal(t, false, user.Permissions["commands"].(Json)["ls_dir"].(Json)["allow"])
+
+	resp, _ = postJson(t, server.URL+"/set_user_permissions/"+key, adminHeader, Json{
+		"username":    "username",
+		"permissions": Json{"commands": Json{"ls_dir": Json{"allow": true}}},
+	})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestLivePermissionUpdates(t *testing.T) {
+	store := NewMemoryStore()
+	if err := setup(store); err != nil {
+		panic(err.Error())
+	}
+
+	wsController := NewWsController("admin", "admin", store, "")
+	server := httptest.NewServer(wsController.routes())
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	authHeader := http.Header{"X-Username": []string{"username"}, "X-Password": []string{"passwd"}}
+	adminHeader := http.Header{
+		"X-Username": []string{fmt.Sprintf("%x", sha256.Sum256([]byte("admin")))},
+		"X-Password": []string{fmt.Sprintf("%x", sha256.Sum256([]byte("admin")))},
+	}
+
+	wsPcConn, _, err := dialPC(wsURL+"/connect/"+key, authHeader, nil)
+	assert.Nil(t, err)
+	defer wsPcConn.Close()
+	userConn, _, err := dialUser(wsURL+"/access/"+key, authHeader)
+	assert.Nil(t, err)
+	defer userConn.Close()
+
+	info := make(Json)
+	assert.Nil(t, wsPcConn.ReadJSON(&info))
+
+	// tightened while connected, the user is told the new rules
+	resp, _ := postJson(t, server.URL+"/set_user_permissions/"+key, adminHeader, Json{
+		"username":    "username",
+		"permissions": Json{"commands": Json{"ls_dir": Json{"allow": false, "restrictions": []interface{}{Json{"path": "${home}", "allow": true}}}}},
+	})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	notice := make(Json)
+	assert.Nil(t, userConn.ReadJSON(&notice))
+	assert.Equal(t, float64(0xf9), notice["code"])
+	assert.Equal(t, Json{
+		"commands": Json{"ls_dir": []interface{}{Json{"source": "user", "allow": false, "restrictions": []interface{}{
+			Json{"path": "/home/username", "allow": true},
+		}}}},
+		"default_allow": true,
+	}, notice["data"])
+
+	assert.Nil(t, userConn.WriteJSON(Json{"type": "command", "cmd": "ls_dir", "args": []interface{}{"/home/test"}}))
+	msg := make(Json)
+	assert.Nil(t, userConn.ReadJSON(&msg))
+	assert.Equal(t, float64(PermissionDenied), msg["error_code"])
+
+	// malformed commands never reach the permissions
+	assert.Nil(t, userConn.WriteJSON(Json{"type": "command", "cmd": "ls_dir", "args": []interface{}{"/home/username", true}}))
+	msg = make(Json)
+	assert.Nil(t, userConn.ReadJSON(&msg))
+	assert.Equal(t, float64(InvalidArguments), msg["error_code"])
+	assert.Equal(t, "Invalid arguments: wrong number of arguments, expected 1, got 2", msg["error_msg"])
+
+	// or disconnected, if the admin asks for it
+	resp, _ = postJson(t, server.URL+"/set_user_permissions/"+key, adminHeader, Json{
+		"username":         "username",
+		"permissions":      Json{"commands": Json{"ls_dir": Json{"allow": false}}},
+		"force_disconnect": true,
+	})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, _, err = userConn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+	assert.Contains(t, err.Error(), permissionsChangedReason)
+}
+
+func TestCheckPermission(t *testing.T) {
+	store := NewMemoryStore()
+	if err := setup(store); err != nil {
+		panic(err.Error())
+	}
+	store.InsertRole(&RoleRecord{Name: "cleanup", Permissions: Json{"commands": Json{
+		"rename_file": Json{"allow": false, "restrictions": []interface{}{Json{"path": "/tmp", "allow": true}, Json{"path": `C:\Temp`, "allow": true}}},
+	}}})
+	store.SetUserRoles("username", key, []string{"cleanup"})
+
+	wsController := NewWsController("admin", "admin", store, "")
+	server := httptest.NewServer(wsController.routes())
+	defer server.Close()
+
+	adminHeader := http.Header{
+		"X-Username": []string{fmt.Sprintf("%x", sha256.Sum256([]byte("admin")))},
+		"X-Password": []string{fmt.Sprintf("%x", sha256.Sum256([]byte("admin")))},
+	}
+	check := func(username, cmd string, args ...interface{}) (*http.Response, Json) {
+		return postJson(t, server.URL+"/check_permission/"+key, adminHeader, Json{"username": username, "cmd": cmd, "args": args})
+	}
+
+	resp, body := check("username", "download_file", "/home/test/a.txt")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, false, body["allow"])
+	assert.Equal(t, "user", body["source"])
+	assert.Equal(t, "Not allowed on /home/test/a.txt", body["reason"])
+	assert.Equal(t, []interface{}{Json{
+		"path":        "/home/test/a.txt",
+		"allow":       false,
+		"restriction": Json{"path": "/home/test", "allow": false, "allow_subdir": true},
+	}}, body["paths"])
+
+	// the args are canonicalized first, as when the user sends the command
+	_, body = check("username", "download_file", "/home/test/public/../a.txt")
+	assert.Equal(t, false, body["allow"])
+	assert.Equal(t, []interface{}{"/home/test/a.txt"}, body["args"])
+
+	_, body = check("username", "download_file", "/home/../../etc/passwd")
+	assert.Equal(t, false, body["allow"])
+	assert.Equal(t, "Invalid arguments: path escapes the root", body["reason"])
+
+	_, body = check("username", "rename_file", "/tmp/a", "/etc/a")
+	assert.Equal(t, false, body["allow"])
+	assert.Equal(t, "role:cleanup", body["source"])
+	assert.Equal(t, "Not allowed on /etc/a", body["reason"])
+
+	_, body = check("username", "create_dir", "/opt/backup")
+	assert.Equal(t, true, body["allow"])
+	assert.Equal(t, "Command is not restricted", body["reason"])
+	assert.Nil(t, body["source"])
+
+	_, body = check("username", "run_script", "/opt/backup.sh")
+	assert.Equal(t, false, body["allow"])
+	assert.Equal(t, "Command is not registered, it must be allowed explicitly", body["reason"])
+	assert.Equal(t, []interface{}{"/opt/backup.sh"}, body["args"])
+
+	// paths of Windows PCs, the OS is given when the PC isn't connected
+	resp, body = postJson(t, server.URL+"/check_permission/"+key, adminHeader, Json{"username": "username", "cmd": "rename_file", "args": []interface{}{`c:\TEMP\a`, `C:/temp/b`}, "os": "windows"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, true, body["allow"])
+	assert.Equal(t, []interface{}{`C:\TEMP\a`, `C:\temp\b`}, body["args"])
+
+	_, body = postJson(t, server.URL+"/check_permission/"+key, adminHeader, Json{"username": "username", "cmd": "rename_file", "args": []interface{}{"/temp/a", "/temp/b"}, "os": "windows"})
+	assert.Equal(t, "Invalid arguments: invalid path", body["reason"])
+
+	resp, _ = postJson(t, server.URL+"/check_permission/"+key, adminHeader, Json{"username": "username", "cmd": "ls_dir", "args": []interface{}{}, "os": "plan9"})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// a connected PC declares its OS and the commands it can run
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	authHeader := http.Header{"X-Username": []string{"username"}, "X-Password": []string{"passwd"}}
+	hello := testHello("windows")
+	hello["commands"] = []interface{}{"rename_file"}
+	wsPcConn, _, err := dialPC(wsURL+"/connect/"+key, authHeader, hello)
+	assert.Nil(t, err)
+	defer wsPcConn.Close()
+
+	_, body = check("username", "rename_file", `C:\Temp\a`, `C:\Temp\b`)
+	assert.Equal(t, true, body["allow"])
+
+	_, body = check("username", "power", "restart")
+	assert.Equal(t, false, body["allow"])
+	assert.Equal(t, "Command not supported by the PC", body["reason"])
+
+	// users that couldn't send the command from a session are denied
+	expired := time.Now().Add(-time.Minute)
+	store.SetUserAccess("username", key, &UserAccess{ExpiresAt: &expired})
+	_, body = check("username", "rename_file", `C:\Temp\a`, `C:\Temp\b`)
+	assert.Equal(t, false, body["allow"])
+	assert.Equal(t, accessExpired, body["reason"])
+	store.SetUserAccess("username", key, nil)
+
+	store.SetUserObserverOnly("username", key, true)
+	_, body = check("username", "rename_file", `C:\Temp\a`, `C:\Temp\b`)
+	assert.Equal(t, false, body["allow"])
+	assert.Equal(t, "Observer sessions are read-only", body["reason"])
+	store.SetUserObserverOnly("username", key, false)
+
+	resp, _ = check("nobody", "ls_dir", "/")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = postJson(t, server.URL+"/check_permission/"+key, adminHeader, Json{"username": "username", "cmd": "ls_dir"})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPermissionEvaluation(t *testing.T) {
+	boolean := func(value bool) *bool { return &value }
+
+	permissions := Permissions{Commands: map[string]CommandRule{
+		"ls_dir": {Allow: false, Restrictions: []PathRestriction{
+			{Path: "/home/test", Allow: true},
+		}},
+		"download_file": {Allow: true, Restrictions: []PathRestriction{
+			// order doesn't matter, the most specific one wins
+			{Path: "/home/test/public", Allow: true},
+			{Path: "/home/test", Allow: false, AllowSubdir: boolean(false)},
+		}},
+		"delete_file": {Allow: false, Restrictions: []PathRestriction{
+			{Path: "/home/test/some/dir", Allow: true, AllowSubdir: boolean(true)},
+			{Path: "/home/test/some/dir/", Allow: false, AllowSubdir: boolean(true)}, // same path, deny wins
+			{Path: "/tmp", Allow: true, AllowSubdir: boolean(false)},
+		}},
+		"upload_file": {Allow: false},
+		"rename_file": {Allow: false, Restrictions: []PathRestriction{{Path: "/tmp", Allow: true}}},
+		"sync_files":  {Allow: true},
+		"run_script":  {Allow: false},
+	}}
+
+	tests := []struct {
+		cmd   string
+		args  []interface{}
+		allow bool
+	}{
+		{"ls_dir", []interface{}{"/home/test"}, true},
+		{"ls_dir", []interface{}{"/home/test/dir"}, true},
+		{"ls_dir", []interface{}{"/home/testing"}, false},
+		{"ls_dir", []interface{}{"/home"}, false},
+		{"ls_dir", []interface{}{"home/test"}, false},
+		{"ls_dir", []interface{}{}, false},
+
+		{"download_file", []interface{}{"/home/test/file"}, false},
+		{"download_file", []interface{}{"/home/test/dir/file"}, false},
+		{"download_file", []interface{}{"/home/test/public/file"}, true},
+		{"download_file", []interface{}{"/home/test/public/dir/file"}, true},
+		{"download_file", []interface{}{"/home/testing/file"}, true},
+		{"download_file", []interface{}{"/etc/passwd"}, true},
+
+		{"delete_file", []interface{}{"/home/test/some/dir/file"}, false},
+		{"delete_file", []interface{}{"/home/test/some/dir/sub/file"}, true},
+		{"delete_file", []interface{}{"/tmp/file"}, true},
+		{"delete_file", []interface{}{"/tmp/dir/file"}, false},
+		{"delete_file", []interface{}{"/tmpfile"}, false},
+
+		// every path must be allowed, not only the first one
+		{"rename_file", []interface{}{"/tmp/file", "/etc/passwd"}, false},
+		{"rename_file", []interface{}{"/tmp/file", "/tmp/other"}, true},
+		// commands that are not registered have no paths and must be allowed explicitly
+		{"sync_files", []interface{}{"/tmp/file", 10, "/etc/passwd"}, true},
+		{"run_script", []interface{}{"echo hi"}, false},
+		{"move_file", []interface{}{"/tmp/file"}, false},
+
+		{"upload_file", []interface{}{"/tmp/file"}, false},
+		{"create_dir", []interface{}{"/tmp/dir"}, true}, // no rule
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.allow, permissions.allows(permissionRequest{cmd: test.cmd, args: test.args}), "%s %v", test.cmd, test.args)
+	}
+}
+
+func TestPermissionPatterns(t *testing.T) {
+	stored := Json{"commands": Json{
+		"download_file": Json{"allow": true, "restrictions": []interface{}{
+			Json{"path": "/home", "allow": false},
+			Json{"path": "${home}", "allow": true},
+			Json{"path": "*.key", "allow": false},
+		}},
+		"delete_file": Json{"allow": true, "restrictions": []interface{}{
+			Json{"path": "/home/*/Documents/**", "allow": false},
+			Json{"path": "/home/alice/Documents/tmp", "allow": true},
+		}},
+	}}
+
+	_, err := ParsePermissions(stored)
+	assert.Nil(t, err)
+
+	alice := NewUser(&UserRecord{Username: "alice", Permissions: stored}, nil, false)
+	bob := NewUser(&UserRecord{Username: "bob", Permissions: stored}, nil, false)
+
+	tests := []struct {
+		user  *User
+		cmd   string
+		path  string
+		allow bool
+	}{
+		{alice, "download_file", "/home/alice/file", true},
+		{alice, "download_file", "/home/alice/dir/file", true},
+		{alice, "download_file", "/home/bob/file", false},
+		{bob, "download_file", "/home/bob/file", true},
+		{alice, "download_file", "/home/alice/.ssh/id.key", false},
+		{alice, "download_file", "/etc/ssl/server.key", false},
+		{alice, "download_file", "/etc/ssl/server.pem", true},
+
+		{alice, "delete_file", "/home/alice/Documents/report.pdf", false},
+		{bob, "delete_file", "/home/bob/Documents/a/b/report.pdf", false},
+		{alice, "delete_file", "/home/alice/Documents/tmp/file", true},
+		{alice, "delete_file", "/home/alice/Downloads/file", true},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.allow, test.user.havePermission(test.cmd, []interface{}{test.path}), "%s %s %s", test.user.username, test.cmd, test.path)
+	}
+
+	_, err = ParsePermissions(Json{"commands": Json{"ls_dir": Json{"allow": true, "restrictions": []interface{}{
+		Json{"path": "${user}/Documents", "allow": true},
+		Json{"path": "/home/[a-", "allow": true},
+	}}}})
+	assert.Equal(t, PermissionsError{
+		{"commands.ls_dir.restrictions[0].path", "unknown variable ${user}"},
+		{"commands.ls_dir.restrictions[1].path", `invalid pattern "[a-"`},
+	}, err)
+}
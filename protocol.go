@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+/*
+Protocol versions spoken with PCs and users
+
+	1  flat JSON objects, "type" next to the other fields (messages without it are relayed as they are)
+	2  every message is an envelope: {"type": "...", "id": "...", "version": 2, "session": "...", "payload": {...}}
+
+PCs ask for a version in their hello and get the highest both speak, users ask with /access/{key}?version=2.
+Version 2 messages with an unknown type or a version other than the negotiated one are rejected
+*/
+const (
+	minProtocolVersion = 1
+	protocolVersion    = 2
+)
+
+// message types
+const (
+	helloType        = "hello"
+	commandType      = "command"
+	infoType         = "info"
+	errorType        = "error"
+	commandErrorType = "command_error" // a command rejected by the server
+	dataType         = "message"       // anything else, relayed between the PC and the users
+)
+
+var (
+	// userTypes - what users can send
+	userTypes = map[string]bool{commandType: true, infoType: true, dataType: true}
+	// pcTypes - what PCs can send, after the hello
+	pcTypes = map[string]bool{infoType: true, errorType: true, dataType: true}
+	// protocolTypes - every type the server sends or reads
+	protocolTypes = map[string]bool{
+		helloType: true, commandType: true, infoType: true, errorType: true, commandErrorType: true, dataType: true,
+	}
+)
+
+// infoCode - code of the info messages sent by the server
+type infoCode int
+
+const (
+	codeUserDisconnected   infoCode = 0x00 // to the PC, data is the username
+	codeHelloAccepted      infoCode = 0xf6 // to the PC, data has the negotiated protocol_version
+	codePcInfo             infoCode = 0xf7 // to a user that attached, data is the hello of the PC
+	codePermissions        infoCode = 0xf8 // to a user that asked for its rules
+	codePermissionsChanged infoCode = 0xf9 // to a user, data has the new rules
+	codeShutdown           infoCode = 0xfa // to everyone, data is the drain period in seconds
+	codeObservers          infoCode = 0xfb // to the PC, data lists the observers
+	codeUserConnected      infoCode = 0xfc // to the PC, data is the username
+)
+
+// infoCodes - the code table, published in /protocol
+var infoCodes = map[string]infoCode{
+	"user_disconnected":   codeUserDisconnected,
+	"hello_accepted":      codeHelloAccepted,
+	"pc_info":             codePcInfo,
+	"permissions":         codePermissions,
+	"permissions_changed": codePermissionsChanged,
+	"shutdown":            codeShutdown,
+	"observers":           codeObservers,
+	"user_connected":      codeUserConnected,
+}
+
+var errorCodes = map[string]ErrorCode{
+	"permission_denied": PermissionDenied,
+	"invalid_arguments": InvalidArguments,
+	"internal_error":    InternalError,
+	"invalid_command":   InvalidCommand,
+	"not_supported":     NotSupported,
+	"timeout":           Timeout,
+	"too_many_commands": TooManyCommands,
+}
+
+// envelope - a message in version 2
+type envelope struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Version int             `json:"version"`
+	Session string          `json:"session,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// message - a message of any version, Payload is one of the payload types or the json.RawMessage read
+type message struct {
+	Type    string
+	ID      string
+	Session string
+	Payload interface{}
+}
+
+type infoPayload struct {
+	Code infoCode    `json:"code"`
+	Msg  string      `json:"msg,omitempty"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// infoRequestPayload - a user asking for information, permissions is answered by the server
+type infoRequestPayload struct {
+	Info string `json:"info"`
+}
+
+type commandPayload struct {
+	Cmd  string        `json:"cmd"`
+	Args []interface{} `json:"args"`
+}
+
+type commandErrorPayload struct {
+	Cmd  string    `json:"cmd_response"`
+	Code ErrorCode `json:"error_code"`
+	Msg  string    `json:"error_msg"`
+}
+
+type errorPayload struct {
+	Error string `json:"error"`
+}
+
+// versioned - a connection that speaks a protocol version
+type versioned interface {
+	Client
+	protocol() int
+}
+
+// parseProtocolVersion reads the version a user asks for, 1 if empty
+func parseProtocolVersion(value string) (int, error) {
+	if len(value) == 0 {
+		return minProtocolVersion, nil
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(value, "%d", &version); err != nil || fmt.Sprint(version) != value {
+		return 0, fmt.Errorf("invalid protocol version %q", value)
+	}
+	if version < minProtocolVersion || version > protocolVersion {
+		return 0, fmt.Errorf("unsupported protocol version %d, the server speaks %d to %d", version, minProtocolVersion, protocolVersion)
+	}
+	return version, nil
+}
+
+// sendMessage writes the message the way the protocol version of the client expects it
+func sendMessage(client versioned, msg message) error {
+	_, toPC := client.(*RemotePC)
+	data, err := msg.encode(client.protocol(), toPC)
+	if err != nil {
+		return err
+	}
+	return ClientWriteText(client, data)
+}
+
+func sendInfo(client versioned, code infoCode, msg string, data interface{}) error {
+	return sendMessage(client, message{Type: infoType, Payload: infoPayload{code, msg, data}})
+}
+
+func sendError(client versioned, err string) error {
+	return sendMessage(client, message{Type: errorType, Payload: errorPayload{err}})
+}
+
+/*
+encode returns the message in the version
+
+In version 1 the payload fields are sent with type, session and id next to them,
+messages relayed as they are (dataType) don't get a type. Relayed to the PC (toPC)
+they also lose the fields a version 1 PC would take for a command, replies of the PC
+keep them
+*/
+func (msg message) encode(version int, toPC bool) ([]byte, error) {
+	payload, err := json.Marshal(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if version >= 2 {
+		return json.Marshal(envelope{msg.Type, msg.ID, version, msg.Session, payload})
+	}
+
+	fields := make(Json)
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, fmt.Errorf("%s payload must be an object", msg.Type)
+	}
+	if msg.Type != dataType {
+		fields["type"] = msg.Type
+	} else {
+		if msgType, ok := fields["type"].(string); !ok || protocolTypes[msgType] {
+			delete(fields, "type")
+		}
+		if toPC {
+			delete(fields, "cmd")
+			delete(fields, "args")
+		}
+	}
+	if len(msg.Session) > 0 {
+		fields["session"] = msg.Session
+	}
+	if len(msg.ID) > 0 {
+		fields["id"] = msg.ID
+	}
+	return json.Marshal(fields)
+}
+
+/*
+decodeMessage reads a message sent in the version, the payload is left as a json.RawMessage
+
+Version 1 messages without a type, or with one the server doesn't know, are dataType
+with the whole object as payload. Version 2 messages must be envelopes with a type in known
+*/
+func decodeMessage(version int, data []byte, known map[string]bool) (message, error) {
+	if version >= 2 {
+		var env envelope
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&env); err != nil {
+			return message{}, fmt.Errorf("invalid message: %s", err.Error())
+		}
+		if env.Version != version {
+			return message{}, fmt.Errorf("message version %d, the connection speaks %d", env.Version, version)
+		}
+		if !known[env.Type] {
+			return message{}, fmt.Errorf("unknown message type %q", env.Type)
+		}
+		if len(env.Payload) == 0 {
+			env.Payload = json.RawMessage("{}")
+		}
+		return message{env.Type, env.ID, env.Session, env.Payload}, nil
+	}
+
+	var fields Json
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return message{}, errors.New("invalid message: not a JSON object")
+	}
+
+	msg := message{Type: dataType}
+	msg.Session, _ = fields["session"].(string)
+	msg.ID, _ = fields["id"].(string)
+	delete(fields, "session")
+	delete(fields, "id")
+	if msgType, ok := fields["type"].(string); ok && known[msgType] {
+		msg.Type = msgType
+		delete(fields, "type")
+	}
+
+	payload, err := json.Marshal(fields)
+	msg.Payload = json.RawMessage(payload)
+	return msg, err
+}
+
+/*
+checkUserData rejects data from users that a version 1 PC could take for something else,
+PCs tell commands by their fields, so users can't send an unknown type or cmd/args without
+the command type (which is validated and checked against the permissions)
+*/
+func checkUserData(msg message) error {
+	var fields Json
+	if err := msg.decodePayload(&fields); err != nil {
+		return err
+	}
+	if msgType, found := fields["type"]; found {
+		return fmt.Errorf("unknown message type %q", fmt.Sprint(msgType))
+	}
+	_, hasCmd := fields["cmd"]
+	_, hasArgs := fields["args"]
+	if hasCmd || hasArgs {
+		return errors.New(`commands must have type "command"`)
+	}
+	return nil
+}
+
+// decodePayload reads the payload of a decoded message into value
+func (msg message) decodePayload(value interface{}) error {
+	raw, ok := msg.Payload.(json.RawMessage)
+	if !ok {
+		return errors.New("payload already decoded")
+	}
+	if err := json.Unmarshal(raw, value); err != nil {
+		return fmt.Errorf("invalid %s payload: %s", msg.Type, err.Error())
+	}
+	return nil
+}
+
+// protocolInfo publishes the protocol versions and the code tables
+func (wsController *WsController) protocolInfo() http.HandlerFunc {
+	return func(response http.ResponseWriter, req *http.Request) {
+		writeJson(response, http.StatusOK, Json{
+			"versions":    []int{minProtocolVersion, protocolVersion},
+			"info_codes":  infoCodes,
+			"error_codes": errorCodes,
+		})
+	}
+}
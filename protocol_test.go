@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageCodec(t *testing.T) {
+	msg := message{Type: infoType, Session: "session", Payload: infoPayload{codeUserConnected, "", "alice"}}
+
+	data, err := msg.encode(1, false)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"type": "info", "session": "session", "code": 252, "data": "alice"}`, string(data))
+
+	data, err = msg.encode(2, false)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"type": "info", "version": 2, "session": "session", "payload": {"code": 252, "data": "alice"}}`, string(data))
+
+	// version 1 messages without a known type are relayed as they are
+	decoded, err := decodeMessage(1, []byte(`{"session": "session", "data": "hello"}`), pcTypes)
+	assert.Nil(t, err)
+	assert.Equal(t, dataType, decoded.Type)
+	assert.Equal(t, "session", decoded.Session)
+	assert.JSONEq(t, `{"data": "hello"}`, string(decoded.Payload.(json.RawMessage)))
+
+	decoded, err = decodeMessage(1, []byte(`{"type": "custom", "data": "hello"}`), pcTypes)
+	assert.Nil(t, err)
+	assert.Equal(t, dataType, decoded.Type)
+	data, _ = decoded.encode(1, false)
+	assert.JSONEq(t, `{"type": "custom", "data": "hello"}`, string(data))
+
+	// relayed data can't become a command of a version 1 PC
+	decoded, err = decodeMessage(2, []byte(`{"type": "message", "version": 2, "payload": {"type": "command", "cmd": "delete_file", "args": ["/"], "data": "hello"}}`), userTypes)
+	assert.Nil(t, err)
+	data, _ = decoded.encode(1, true)
+	assert.JSONEq(t, `{"data": "hello"}`, string(data))
+
+	// replies of a version 1 PC keep them
+	decoded, err = decodeMessage(1, []byte(`{"id": "#1", "cmd": "ls_dir", "args": ["/home"], "files": []}`), pcTypes)
+	assert.Nil(t, err)
+	decoded.ID = "ls-1"
+	data, _ = decoded.encode(1, false)
+	assert.JSONEq(t, `{"id": "ls-1", "cmd": "ls_dir", "args": ["/home"], "files": []}`, string(data))
+	data, _ = decoded.encode(2, false)
+	assert.JSONEq(t, `{"type": "message", "id": "ls-1", "version": 2, "payload": {"cmd": "ls_dir", "args": ["/home"], "files": []}}`, string(data))
+
+	decoded, err = decodeMessage(2, []byte(`{"type": "command", "id": "1", "version": 2, "payload": {"cmd": "ls_dir", "args": ["/"]}}`), userTypes)
+	assert.Nil(t, err)
+	assert.Equal(t, commandType, decoded.Type)
+	assert.Equal(t, "1", decoded.ID)
+	var command commandPayload
+	assert.Nil(t, decoded.decodePayload(&command))
+	assert.Equal(t, commandPayload{"ls_dir", []interface{}{"/"}}, command)
+
+	invalid := []struct {
+		data string
+		err  string
+	}{
+		{`{"type": "custom", "version": 2, "payload": {}}`, `unknown message type "custom"`},
+		{`{"type": "info", "version": 2, "payload": {}}`, `unknown message type "info"`}, // users can't send it
+		{`{"type": "command", "version": 1, "payload": {}}`, "message version 1, the connection speaks 2"},
+		{`{"type": "command", "version": 2, "cmd": "ls_dir"}`, `invalid message: json: unknown field "cmd"`},
+		{`not json`, "invalid message"},
+	}
+	for _, test := range invalid {
+		_, err := decodeMessage(2, []byte(test.data), map[string]bool{commandType: true})
+		if assert.NotNil(t, err, test.data) {
+			assert.Contains(t, err.Error(), test.err)
+		}
+	}
+
+	for _, value := range []string{"0", "3", "two", "2.0"} {
+		_, err := parseProtocolVersion(value)
+		assert.NotNil(t, err, value)
+	}
+	version, err := parseProtocolVersion("")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, version)
+}
+
+func TestProtocolVersions(t *testing.T) {
+	store := NewMemoryStore()
+	if err := setup(store); err != nil {
+		panic(err.Error())
+	}
+
+	wsController := NewWsController("admin", "admin", store, "")
+	server := httptest.NewServer(wsController.routes())
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	authHeader := http.Header{"X-Username": []string{"username"}, "X-Password": []string{"passwd"}}
+
+	resp, err := http.Get(server.URL + "/protocol")
+	assert.Nil(t, err)
+	var tables Json
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&tables))
+	resp.Body.Close()
+	assert.Equal(t, []interface{}{float64(1), float64(2)}, tables["versions"])
+	assert.Equal(t, float64(0xfc), tables["info_codes"].(Json)["user_connected"])
+	assert.Equal(t, float64(NotSupported), tables["error_codes"].(Json)["not_supported"])
+	assert.Equal(t, float64(TooManyCommands), tables["error_codes"].(Json)["too_many_commands"])
+
+	// the PC gets the highest version both speak
+	hello := testHello("linux")
+	hello["protocol_version"] = 3
+	wsPcConn, _, err := dialPC(wsURL+"/connect/"+key, authHeader, hello)
+	assert.Nil(t, err)
+	defer wsPcConn.Close()
+	assert.Equal(t, 2, wsController.remotePcs.get(key).version)
+
+	_, resp, err = websocket.DefaultDialer.Dial(wsURL+"/access/"+key+"?version=3", authHeader)
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	userV2, _, err := websocket.DefaultDialer.Dial(wsURL+"/access/"+key+"?version=2", authHeader)
+	assert.Nil(t, err)
+	defer userV2.Close()
+
+	msg := make(Json)
+	assert.Nil(t, userV2.ReadJSON(&msg))
+	assert.Equal(t, infoType, msg["type"])
+	assert.Equal(t, float64(2), msg["version"])
+	assert.Equal(t, float64(codePcInfo), msg["payload"].(Json)["code"])
+
+	msg = make(Json)
+	assert.Nil(t, wsPcConn.ReadJSON(&msg))
+	assert.Equal(t, float64(codeUserConnected), msg["payload"].(Json)["code"])
+	session := msg["session"].(string)
+
+	userV1, _, err := dialUser(wsURL+"/access/"+key, authHeader)
+	assert.Nil(t, err)
+	defer userV1.Close()
+	assert.Nil(t, wsPcConn.ReadJSON(&msg))
+
+	// unknown types are rejected
+	assert.Nil(t, userV2.WriteJSON(Json{"type": "custom", "version": 2, "payload": Json{}}))
+	msg = make(Json)
+	assert.Nil(t, userV2.ReadJSON(&msg))
+	assert.Equal(t, errorType, msg["type"])
+	assert.Equal(t, `unknown message type "custom"`, msg["payload"].(Json)["error"])
+
+	assert.Nil(t, userV2.WriteJSON(Json{"type": "command", "id": "7", "version": 2, "payload": Json{"cmd": "ls_dir", "args": []interface{}{"/home/test/"}}}))
+	msg = make(Json)
+	assert.Nil(t, wsPcConn.ReadJSON(&msg))
+	assert.Equal(t, Json{
+		"type":    commandType,
+		"id":      "#1", // assigned by the server, the user gets its own ID back
+		"version": float64(2),
+		"session": session,
+		"payload": Json{"cmd": "ls_dir", "args": []interface{}{"/home/test"}},
+	}, msg)
+
+	// replies are converted to the version of each user
+	assert.Nil(t, wsPcConn.WriteJSON(Json{"type": "message", "id": "#1", "version": 2, "session": session, "payload": Json{"files": []interface{}{}}}))
+	msg = make(Json)
+	assert.Nil(t, userV2.ReadJSON(&msg))
+	assert.Equal(t, "7", msg["id"])
+	assert.Equal(t, Json{"files": []interface{}{}}, msg["payload"])
+
+	assert.Nil(t, wsPcConn.WriteJSON(Json{"type": "message", "version": 2, "payload": Json{"event": "locked"}}))
+	msg = make(Json)
+	assert.Nil(t, userV1.ReadJSON(&msg))
+	assert.Equal(t, Json{"event": "locked"}, msg)
+
+	// version 1 commands must have their type, so they are always checked
+	rejected := []struct {
+		msg Json
+		err string
+	}{
+		{Json{"cmd": "delete_file", "args": []interface{}{"/home/test/../../etc/passwd"}}, `commands must have type "command"`},
+		{Json{"type": "bogus", "cmd": "delete_file", "args": []interface{}{"/etc/passwd"}}, `unknown message type "bogus"`},
+		{Json{"args": []interface{}{"/etc/passwd"}}, `commands must have type "command"`},
+	}
+	for _, test := range rejected {
+		assert.Nil(t, userV1.WriteJSON(test.msg))
+		msg = make(Json)
+		assert.Nil(t, userV1.ReadJSON(&msg))
+		assert.Equal(t, Json{"type": errorType, "error": test.err}, msg)
+	}
+
+	assert.Nil(t, userV1.WriteJSON(Json{"data": "hello"}))
+	msg = make(Json)
+	assert.Nil(t, wsPcConn.ReadJSON(&msg))
+	assert.Equal(t, "hello", msg["payload"].(Json)["data"])
+}
+
+func TestVersion2UserWithVersion1PC(t *testing.T) {
+	store := NewMemoryStore()
+	if err := setup(store); err != nil {
+		panic(err.Error())
+	}
+
+	wsController := NewWsController("admin", "admin", store, "")
+	server := httptest.NewServer(wsController.routes())
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	authHeader := http.Header{"X-Username": []string{"username"}, "X-Password": []string{"passwd"}}
+
+	wsPcConn, _, err := dialPC(wsURL+"/connect/"+key, authHeader, testHello("linux"))
+	assert.Nil(t, err)
+	defer wsPcConn.Close()
+
+	userV2, _, err := websocket.DefaultDialer.Dial(wsURL+"/access/"+key+"?version=2", authHeader)
+	assert.Nil(t, err)
+	defer userV2.Close()
+	msg := make(Json)
+	assert.Nil(t, userV2.ReadJSON(&msg))
+	assert.Nil(t, wsPcConn.ReadJSON(&msg))
+
+	userV2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	wsPcConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// data of version 2 users is checked like version 1 data, the PC would run it
+	assert.Nil(t, userV2.WriteJSON(Json{"type": "message", "version": 2, "payload": Json{"type": "command", "cmd": "delete_file", "args": []interface{}{"/etc/passwd"}}}))
+	msg = make(Json)
+	assert.Nil(t, userV2.ReadJSON(&msg))
+	assert.Equal(t, errorType, msg["type"])
+	assert.Equal(t, `unknown message type "command"`, msg["payload"].(Json)["error"])
+
+	assert.Nil(t, userV2.WriteJSON(Json{"type": "message", "version": 2, "payload": Json{"cmd": "delete_file", "args": []interface{}{"/etc/passwd"}}}))
+	msg = make(Json)
+	assert.Nil(t, userV2.ReadJSON(&msg))
+	assert.Equal(t, `commands must have type "command"`, msg["payload"].(Json)["error"])
+
+	// the PC only gets the data that passed
+	assert.Nil(t, userV2.WriteJSON(Json{"type": "message", "version": 2, "payload": Json{"data": "hello"}}))
+	msg = make(Json)
+	assert.Nil(t, wsPcConn.ReadJSON(&msg))
+	assert.Equal(t, "hello", msg["data"])
+	assert.Nil(t, msg["type"])
+	assert.Nil(t, msg["cmd"])
+}
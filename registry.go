@@ -0,0 +1,84 @@
+package main
+
+import "sync"
+
+/*
+pcRegistry - connected PCs by key
+
+It is the only owner of the PCs map, every operation holds the lock,
+so "PC connect", "user attach" and "PC disconnect" can't interleave
+*/
+type pcRegistry struct {
+	mutex sync.Mutex
+	pcs   map[string]*RemotePC // nil while the PC connection is being upgraded
+}
+
+func newPcRegistry() *pcRegistry {
+	return &pcRegistry{pcs: make(map[string]*RemotePC)}
+}
+
+// reserve claims the key for a PC that is connecting, false if it is already taken
+func (registry *pcRegistry) reserve(key string) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if _, found := registry.pcs[key]; found {
+		return false
+	}
+
+	registry.pcs[key] = nil
+	return true
+}
+
+// connected stores the PC in the key it reserved
+func (registry *pcRegistry) connected(remotePc *RemotePC) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.pcs[remotePc.key] = remotePc
+}
+
+// release frees a reserved key when the PC failed to connect
+func (registry *pcRegistry) release(key string) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if registry.pcs[key] == nil {
+		delete(registry.pcs, key)
+	}
+}
+
+// get returns the connected PC, or nil
+func (registry *pcRegistry) get(key string) *RemotePC {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	return registry.pcs[key]
+}
+
+// remove removes the PC only if it is still the one connected with its key
+func (registry *pcRegistry) remove(remotePc *RemotePC) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if registry.pcs[remotePc.key] != remotePc {
+		return false
+	}
+
+	delete(registry.pcs, remotePc.key)
+	return true
+}
+
+// all returns every connected PC
+func (registry *pcRegistry) all() []*RemotePC {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	pcs := make([]*RemotePC, 0, len(registry.pcs))
+	for _, remotePc := range registry.pcs {
+		if remotePc != nil {
+			pcs = append(pcs, remotePc)
+		}
+	}
+	return pcs
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryReserve(t *testing.T) {
+	registry := newPcRegistry()
+
+	var reserved int32
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if registry.reserve(key) {
+				mutex.Lock()
+				reserved++
+				mutex.Unlock()
+			}
+			registry.get(key)
+			registry.all()
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), reserved, "only one connection can claim a key")
+	assert.Nil(t, registry.get(key), "reserved keys are not connected yet")
+
+	remotePc := &RemotePC{key: key}
+	registry.connected(remotePc)
+	assert.Equal(t, remotePc, registry.get(key))
+
+	// a PC that lost its key can't remove the new one
+	assert.False(t, registry.remove(&RemotePC{key: key}))
+	assert.True(t, registry.remove(remotePc))
+	assert.Nil(t, registry.get(key))
+	assert.True(t, registry.reserve(key))
+	registry.release(key)
+	assert.Empty(t, registry.all())
+}
+
+// run with -race
+func TestConcurrentConnectAndDisconnect(t *testing.T) {
+	const (
+		pcs        = 8
+		iterations = 20
+	)
+
+	store := NewMemoryStore()
+	wsController := NewWsController("test", "test", store, "")
+	server := httptest.NewServer(wsController.routes())
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	bearer := func(claims TokenClaims) http.Header {
+		tokens, err := wsController.issueTokens(claims)
+		assert.Nil(t, err)
+		return http.Header{"Authorization": []string{"Bearer " + tokens["access_token"].(string)}}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < pcs; i++ {
+		pcKey := fmt.Sprintf("pc%d", i)
+		store.InsertPC(&PCRecord{Key: pcKey, Username: "username", Password: "passwd"})
+		store.InsertUser(&UserRecord{Username: "username", Password: "passwd", PcKey: pcKey})
+
+		pcHeader := bearer(TokenClaims{Username: "username", PcKey: pcKey, Role: RolePC})
+		userHeader := bearer(TokenClaims{Username: "username", PcKey: pcKey, Role: RoleUser})
+
+		// the PC connects, a user attaches while it disconnects
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				var pcConn *websocket.Conn
+				assert.Eventually(t, func() bool {
+					conn, _, err := dialPC(wsURL+"/connect/"+pcKey, pcHeader, nil)
+					pcConn = conn
+					return err == nil
+				}, 5*time.Second, time.Millisecond)
+
+				var attach sync.WaitGroup
+				attach.Add(2)
+				go func() {
+					defer attach.Done()
+					userConn, _, err := websocket.DefaultDialer.Dial(wsURL+"/access/"+pcKey, userHeader)
+					if err == nil {
+						userConn.Close()
+					}
+				}()
+				go func() {
+					defer attach.Done()
+					time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+					if pcConn != nil {
+						pcConn.Close()
+					}
+				}()
+				attach.Wait()
+			}
+		}()
+
+		// other connections try to take the key
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				conn, _, err := dialPC(wsURL+"/connect/"+pcKey, pcHeader, nil)
+				if err == nil {
+					conn.Close()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Eventually(t, func() bool {
+		return len(wsController.remotePcs.all()) == 0
+	}, 5*time.Second, 10*time.Millisecond, "every PC must be removed after disconnecting")
+}
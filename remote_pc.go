@@ -1,44 +1,129 @@
 package main
 
 import (
-	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"time"
-
-	"go.mongodb.org/mongo-driver/mongo"
-
-	"go.mongodb.org/mongo-driver/bson"
+	"strings"
+	"sync"
 
 	"github.com/gorilla/websocket"
 )
 
 /*
 RemotePC - PC that can be accessed remotetly
+
+Many users can be connected at the same time, each one with its own session,
+observers get everything the PC sends to any session.
+Messages relayed to the PC carry the session ID ("session" field in JSON messages,
+a binarySession header in binary messages), so the PC can tag its replies the same way
 */
 type RemotePC struct {
-	key string
+	key      string
+	version  int // protocol version negotiated in the hello
+	hello    pcHello
+	commands map[string]bool // the ones the PC can run, from its hello
+	paths    pathFlavor      // how the PC writes its paths, from the OS in its hello
 
 	conn       *websocket.Conn //websocket connection
-	user       *User           // current connected user
+	writer     *connWriter     // the PC reads slowly, users wait for room in its queue
 	controller *WsController
+
+	usersMutex sync.RWMutex
+	users      map[string]*User // connected users by session ID
+	closed     bool             // PC disconnected, no more users can be attached
+
+	pendingMutex   sync.Mutex
+	pending        map[string]*pendingCommand            // commands waiting for a reply, by wire ID
+	sessionPending map[string]map[string]*pendingCommand // the same commands by session ID and user ID
+	lastWireId     int
 }
 
-func (remotePc *RemotePC) getConn() *websocket.Conn {
-	return remotePc.conn
+var errPcDisconnected = errors.New("PC disconnected")
+
+func (remotePc *RemotePC) getWriter() *connWriter {
+	return remotePc.writer
+}
+
+func (remotePc *RemotePC) protocol() int {
+	return remotePc.version
 }
 
 func NewRemotePc(key string, wsConn *websocket.Conn, wsController *WsController) *RemotePC {
+	wsConn.SetReadLimit(maxMessageSize)
 	return &RemotePC{key: key,
-		conn:       wsConn,
-		controller: wsController,
+		conn:           wsConn,
+		writer:         newConnWriter(wsConn, BlockWriter, outboundQueueSize),
+		controller:     wsController,
+		users:          make(map[string]*User),
+		pending:        make(map[string]*pendingCommand),
+		sessionPending: make(map[string]map[string]*pendingCommand),
 	}
 }
 
+// setHello stores what the PC told about itself and the protocol version to use, before it is connected
+func (remotePc *RemotePC) setHello(hello pcHello) {
+	remotePc.version = hello.negotiatedVersion()
+	hello.ProtocolVersion = remotePc.version
+	remotePc.hello = hello
+	remotePc.paths, _ = parsePathFlavor(hello.OS)
+	remotePc.commands = make(map[string]bool, len(hello.Commands))
+	for _, cmd := range hello.Commands {
+		remotePc.commands[cmd] = true
+	}
+}
+
+// supports returns true if the PC said it can run the command
+func (remotePc *RemotePC) supports(cmd string) bool {
+	return remotePc.commands[cmd]
+}
+
+// userConnected attaches the user session, unless the PC already disconnected
 func (remotePc *RemotePC) userConnected(user *User) error {
-	remotePc.user = user
-	return ClientWriteJSON(remotePc, map[string]interface{}{"type": "info", "code": 0xfc, "data": user.username})
+	remotePc.usersMutex.Lock()
+	if remotePc.closed {
+		remotePc.usersMutex.Unlock()
+		return errPcDisconnected
+	}
+	remotePc.users[user.sessionId] = user
+	remotePc.usersMutex.Unlock()
+
+	if user.observer {
+		return remotePc.sendObservers()
+	}
+	return sendMessage(remotePc, message{Type: infoType, Session: user.sessionId, Payload: infoPayload{Code: codeUserConnected, Data: user.username}})
+}
+
+// sendObservers lets the PC know who is observing it
+func (remotePc *RemotePC) sendObservers() error {
+	observers := make([]Json, 0)
+	for _, user := range remotePc.connectedUsers() {
+		if user.observer {
+			observers = append(observers, Json{"username": user.username, "session": user.sessionId})
+		}
+	}
+
+	return sendInfo(remotePc, codeObservers, "", observers)
+}
+
+// getUser returns the user connected with the session ID, or nil
+func (remotePc *RemotePC) getUser(sessionId string) *User {
+	remotePc.usersMutex.RLock()
+	defer remotePc.usersMutex.RUnlock()
+
+	return remotePc.users[sessionId]
+}
+
+func (remotePc *RemotePC) connectedUsers() []*User {
+	remotePc.usersMutex.RLock()
+	defer remotePc.usersMutex.RUnlock()
+
+	users := make([]*User, 0, len(remotePc.users))
+	for _, user := range remotePc.users {
+		users = append(users, user)
+	}
+	return users
 }
 
 func (remotePc *RemotePC) readRoutine() {
@@ -49,56 +134,212 @@ func (remotePc *RemotePC) readRoutine() {
 			break
 		}
 
-		ClientWrite(remotePc.user, msgType, data)
+		remotePc.routeMessage(msgType, data)
+	}
+
+	remotePc.writer.stop()
+	remotePc.conn.Close()
+	remotePc.controller.disconnectPC(remotePc)
+}
+
+/*
+routeMessage sends a message from the PC to the session it replies to, and to every observer
+
+Replies to a command (with the ID the server sent it with) go to the session of the command,
+other messages to a session count as replies to its commands (see sessionReplied).
+Messages without a session are events from the PC, they go to every user.
+Replies to a session that is already gone are dropped, binary messages say where they go
+in their header (see readFrame). Text messages are converted for users that speak another protocol version
+*/
+func (remotePc *RemotePC) routeMessage(msgType int, data []byte) {
+	if msgType == websocket.TextMessage {
+		msg, err := decodeMessage(remotePc.version, data, pcTypes)
+		if err == nil {
+			if remotePc.routeReply(msg) {
+				return
+			}
+			if len(msg.Session) > 0 {
+				remotePc.sessionReplied(msg.Session)
+				if user := remotePc.getUser(msg.Session); user != nil {
+					remotePc.sendToSession(user, func(user *User) { remotePc.relay(user, msg, data) })
+				}
+				return
+			}
+
+			for _, user := range remotePc.connectedUsers() {
+				remotePc.relay(user, msg, data)
+			}
+			return
+		}
+		if remotePc.version >= 2 {
+			log.Printf("Invalid message from PC %s: %s\n", remotePc.key, err.Error())
+			return
+		}
+	} else {
+		session, payload, ok := readFrame(data)
+		if !ok {
+			log.Printf("Invalid binary message from PC %s\n", remotePc.key)
+			return
+		}
+		if len(session) > 0 {
+			remotePc.sessionReplied(session)
+			if user := remotePc.getUser(session); user != nil {
+				remotePc.sendToSession(user, func(user *User) { ClientWrite(user, msgType, payload) })
+			}
+			return
+		}
+		data = payload
+	}
+
+	for _, user := range remotePc.connectedUsers() {
+		ClientWrite(user, msgType, data)
+	}
+}
+
+// sessionFrame returns the binary message of the session with its header
+func sessionFrame(sessionId string, data []byte) []byte {
+	frame := make([]byte, 0, 1+sessionIdLength+len(data))
+	frame = append(frame, binarySession)
+	frame = append(frame, sessionId...)
+	return append(frame, data...)
+}
+
+// readFrame returns the session of a binary message (empty if it goes to every user) and its data, false if the header is invalid
+func readFrame(frame []byte) (string, []byte, bool) {
+	if len(frame) == 0 {
+		return "", nil, false
+	}
+
+	switch frame[0] {
+	case binaryBroadcast:
+		return "", frame[1:], true
+	case binarySession:
+		if len(frame) < 1+sessionIdLength {
+			return "", nil, false
+		}
+		return string(frame[1 : 1+sessionIdLength]), frame[1+sessionIdLength:], true
+	}
+	return "", nil, false
+}
+
+// relay sends a text message of the PC to the user, as it is if they speak the same version
+func (remotePc *RemotePC) relay(user *User, msg message, data []byte) {
+	if user.version == remotePc.version {
+		ClientWriteText(user, data)
+		return
+	}
+	sendMessage(user, msg)
+}
+
+// sendToSession sends with send to the user and to every other observer
+func (remotePc *RemotePC) sendToSession(user *User, send func(user *User)) {
+	send(user)
+
+	for _, observer := range remotePc.connectedUsers() {
+		if observer.observer && observer != user {
+			send(observer)
+		}
 	}
+}
+
+// disconnectUser closes the user session and lets the PC know
+func (remotePc *RemotePC) disconnectUser(user *User) {
+	remotePc.usersMutex.Lock()
+	_, found := remotePc.users[user.sessionId]
+	delete(remotePc.users, user.sessionId)
+	remotePc.usersMutex.Unlock()
+	remotePc.cancelCommands(user)
 
-	remotePc.controller.disconnectPcChan <- remotePc.key
+	if found {
+		user.writer.close(websocket.CloseNormalClosure, "")
+
+		if user.observer {
+			remotePc.sendObservers()
+			return
+		}
+		sendMessage(remotePc, message{Type: infoType, Session: user.sessionId, Payload: infoPayload{codeUserDisconnected, "User disconnected!", user.username}})
+	}
 }
 
-func (remotePc *RemotePC) disconnectUser() {
-	if remotePc.user != nil {
-		remotePc.user.wsConn.WriteControl(websocket.CloseMessage, nil, time.Now().Add(time.Second*10))
-		// remotePc.user.conn.Close()
+// disconnectUsers closes every user session, used when the PC disconnects or the server shuts down
+func (remotePc *RemotePC) disconnectUsers(code int, reason string) {
+	remotePc.usersMutex.Lock()
+	users := remotePc.users
+	remotePc.users = make(map[string]*User)
+	remotePc.closed = true
+	remotePc.usersMutex.Unlock()
+	remotePc.cancelCommands(nil)
 
-		remotePc.user = nil
-		ClientWriteJSON(remotePc, map[string]interface{}{"type": "info", "code": 0x00, "msg": "User disconnected!"})
+	for _, user := range users {
+		user.writer.close(code, reason)
 	}
 }
 
+// sessionCount returns how many users are connected
+func (remotePc *RemotePC) sessionCount() int {
+	remotePc.usersMutex.RLock()
+	defer remotePc.usersMutex.RUnlock()
+	return len(remotePc.users)
+}
+
 //AuthenticatePC checks if PC exists in the database
-func AuthenticatePC(username, password, key string, db *mongo.Database) bool {
-	collection := db.Collection("pcs")
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
+func AuthenticatePC(username, password, key string, store Store) bool {
+	pc, err := store.FindPC(key)
+	if err != nil {
+		return false
+	}
 
-	result := collection.FindOne(ctx, bson.M{"username": username, "password": password, "key": key})
+	if pc.Username != username {
+		return false
+	}
 
-	return result.Err() == nil
+	valid, upgrade := checkPassword(pc.Password, password)
+	if upgrade {
+		// stored in plaintext by an older version, replace it with a hash
+		if hash, err := hashPassword(password); err == nil {
+			if err := store.SetPCPassword(key, hash); err != nil {
+				log.Printf("Failed to upgrade password of PC %s. Error: %s\n", key, err.Error())
+			}
+		}
+	}
+
+	return valid
 }
 
-// CreateRemotePC creates a user for the remote pc
-func CreateRemotePC(authData Json, db *mongo.Database) RegisterError {
+// CreateRemotePC creates a user for the remote pc, the key must be the one of the URL (admin tokens are for a single PC)
+func CreateRemotePC(authData Json, remotePcKey string, store Store) RegisterError {
 	if len(authData) == 3 {
 		if !jsonContainsKeys(authData, []string{"username", "password", "key"}) {
 			return NewRegisterError(http.StatusBadRequest, "invalid request")
 		}
 
-		collection := db.Collection("pcs")
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
+		username, okUsername := authData["username"].(string)
+		password, okPassword := authData["password"].(string)
+		pcKey, okKey := authData["key"].(string)
 
-		pcKey := authData["key"].(string)
+		if !okUsername || !okPassword || !okKey {
+			return NewRegisterError(http.StatusBadRequest, "invalid request")
+		}
 
-		if AuthenticatePC(authData["username"].(string), authData["password"].(string), pcKey, db) {
+		if pcKey != strings.TrimSpace(remotePcKey) {
+			return NewRegisterError(http.StatusForbidden, "key doesn't match the URL")
+		}
+
+		if _, err := store.FindPC(pcKey); err != ErrNotFound {
+			if err != nil {
+				return NewRegisterError(http.StatusInternalServerError, err.Error())
+			}
 			//PC already registered
 			log.Printf("PC with key %s already registered!\n", pcKey)
 			return NewRegisterError(http.StatusBadRequest, fmt.Sprintf("PC with key %s already registered", pcKey))
 		}
 
-		ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
+		passwordHash, err := hashPassword(password)
+		if err != nil {
+			return NewRegisterError(http.StatusInternalServerError, "Failed to hash password")
+		}
 
-		_, err := collection.InsertOne(ctx, authData)
+		err = store.InsertPC(&PCRecord{Key: pcKey, Username: username, Password: passwordHash})
 		if err != nil {
 			return NewRegisterError(http.StatusInternalServerError, err.Error())
 		}
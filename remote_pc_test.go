@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"context"
 	"crypto/sha256"
 	"fmt"
 	"net/http"
@@ -24,12 +23,7 @@ func TestSuitePC(t *testing.T) {
 		pcPassword    = fmt.Sprintf("%x", sha256.Sum256([]byte("passwd")))
 	)
 
-	client, err := setupMongodb("localhost:27017")
-	assert.Nil(t, err)
-
-	client.Database("test_remote_pc").Drop(context.TODO())
-
-	wsController := NewWsController("admin", "admin", "localhost:27017", "test_remote_pc")
+	wsController := NewWsController("admin", "admin", NewMemoryStore(), "")
 	server := httptest.NewServer(wsController.routes())
 
 	defer server.Close()
@@ -86,7 +80,7 @@ func TestSuitePC(t *testing.T) {
 		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/connect/" + key
 
 		authHeader := http.Header{"X-Username": []string{pcUsername}, "X-Password": []string{pcPassword}}
-		wsPcConn, response, err := websocket.DefaultDialer.Dial(url, authHeader)
+		wsPcConn, response, err := dialPC(url, authHeader, nil)
 		assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
 		assert.Nil(t, err)
 
@@ -104,3 +98,39 @@ func TestSuitePC(t *testing.T) {
 	})
 
 }
+
+// testHello - the hello of a version 1 PC running on os that supports every registered command
+func testHello(os string) Json {
+	commands := make([]interface{}, 0, len(commandRegistry))
+	for cmd := range commandRegistry {
+		commands = append(commands, cmd)
+	}
+	return Json{"type": "hello", "agent_version": "1.0.0", "os": os, "hostname": "test", "protocol_version": 1, "commands": commands}
+}
+
+// dialPC connects a PC and sends its hello (testHello("linux") if nil), it returns once the server accepted it
+func dialPC(url string, header http.Header, hello Json) (*websocket.Conn, *http.Response, error) {
+	conn, response, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		return nil, response, err
+	}
+
+	if hello == nil {
+		hello = testHello("linux")
+	}
+	reply := make(Json)
+	if err = conn.WriteJSON(hello); err == nil {
+		err = conn.ReadJSON(&reply)
+	}
+	if payload, ok := reply["payload"].(Json); ok {
+		reply = payload
+	}
+	if err == nil && reply["code"] != float64(codeHelloAccepted) {
+		err = fmt.Errorf("hello not accepted: %v", reply)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, response, err
+	}
+	return conn, response, nil
+}
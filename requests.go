@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// commandTimeout - how long the PC has to reply to a command, set from the configuration (see Config.apply)
+var commandTimeout = 30 * time.Second
+
+// maxPendingCommands - commands a session can have waiting for the PC, set from the configuration
+var maxPendingCommands = 64
+
+// requestIdPattern - IDs users can give their commands, the ones the server assigns start with wireIdPrefix
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+const wireIdPrefix = "#"
+
+var errRequestId = errors.New("invalid request ID, use up to 64 letters, digits or . _ : -")
+
+var errTooManyCommands = errors.New("too many commands waiting for the PC, retry when some of them end")
+
+/*
+pendingCommand - a command sent to the PC, kept while the PC may still reply to it
+
+The PC gets it with an ID assigned by the server (unique in the PC), its replies with
+that ID go only to the session that sent the command, with the ID of the user.
+Replies tagged only with the session (binary messages, or text ones without the ID)
+count as replies to every command of the session.
+A command can get many replies, it ends with an error or a reply with "final": true,
+or when the PC sends nothing for commandTimeout after replying
+*/
+type pendingCommand struct {
+	user     *User
+	wireId   string
+	id       string // the one the user gave, or the wire ID
+	cmd      string
+	replied  bool
+	deadline time.Time // moved on every reply
+	timer    *time.Timer
+}
+
+/*
+trackCommand registers a command of the user and returns the ID it is sent to the PC with
+
+id is the one the user gave, if any, it must not be used by another command
+of the session that didn't end yet. A session can't have more than maxPendingCommands.
+The user gets a Timeout error if the PC doesn't reply in commandTimeout
+*/
+func (remotePc *RemotePC) trackCommand(user *User, id, cmd string) (string, error) {
+	remotePc.pendingMutex.Lock()
+	defer remotePc.pendingMutex.Unlock()
+
+	session := remotePc.sessionPending[user.sessionId]
+	if _, found := session[id]; found {
+		return "", fmt.Errorf("request ID %q is already in use", id)
+	}
+	if len(session) >= maxPendingCommands {
+		return "", errTooManyCommands
+	}
+
+	remotePc.lastWireId++
+	wireId := fmt.Sprintf("%s%d", wireIdPrefix, remotePc.lastWireId)
+	if len(id) == 0 {
+		id = wireId
+	}
+
+	pending := &pendingCommand{user: user, wireId: wireId, id: id, cmd: cmd, deadline: time.Now().Add(commandTimeout)}
+	pending.timer = time.AfterFunc(commandTimeout, func() { remotePc.commandTimedOut(wireId) })
+	remotePc.pending[wireId] = pending
+	if session == nil {
+		session = make(map[string]*pendingCommand)
+		remotePc.sessionPending[user.sessionId] = session
+	}
+	session[id] = pending
+	return wireId, nil
+}
+
+// forgetCommand removes the command, pendingMutex must be held
+func (remotePc *RemotePC) forgetCommand(pending *pendingCommand) {
+	pending.timer.Stop()
+	delete(remotePc.pending, pending.wireId)
+
+	sessionId := pending.user.sessionId
+	delete(remotePc.sessionPending[sessionId], pending.id)
+	if len(remotePc.sessionPending[sessionId]) == 0 {
+		delete(remotePc.sessionPending, sessionId)
+	}
+}
+
+// extend gives the PC another commandTimeout to send the next reply, pendingMutex must be held
+func (pending *pendingCommand) extend() {
+	pending.replied = true
+	pending.deadline = time.Now().Add(commandTimeout)
+	pending.timer.Reset(commandTimeout)
+}
+
+/*
+commandReplied returns the command sent with the wire ID, nil if there isn't one
+
+The command is removed if the reply is its last one, otherwise the PC gets
+another commandTimeout to send the next reply
+*/
+func (remotePc *RemotePC) commandReplied(wireId string, last bool) *pendingCommand {
+	remotePc.pendingMutex.Lock()
+	defer remotePc.pendingMutex.Unlock()
+
+	pending, found := remotePc.pending[wireId]
+	if !found {
+		return nil
+	}
+	if last {
+		remotePc.forgetCommand(pending)
+		return pending
+	}
+
+	pending.extend()
+	return pending
+}
+
+/*
+sessionReplied counts a message of the PC to the session as a reply to each of its commands
+
+The PC doesn't say which command binary messages, or text messages without the ID, reply to.
+The commands don't end, the PC gets another commandTimeout to send the next reply
+*/
+func (remotePc *RemotePC) sessionReplied(sessionId string) {
+	remotePc.pendingMutex.Lock()
+	defer remotePc.pendingMutex.Unlock()
+
+	for _, pending := range remotePc.sessionPending[sessionId] {
+		pending.extend()
+	}
+}
+
+/*
+commandTimedOut forgets the command, the user gets a Timeout error if the PC never replied
+
+Replies the PC sends after this are dropped, like the ones to commands that ended
+*/
+func (remotePc *RemotePC) commandTimedOut(wireId string) {
+	remotePc.pendingMutex.Lock()
+	pending, found := remotePc.pending[wireId]
+	if !found || time.Now().Before(pending.deadline) {
+		// ended, or replied while the timer fired
+		remotePc.pendingMutex.Unlock()
+		return
+	}
+	remotePc.forgetCommand(pending)
+	remotePc.pendingMutex.Unlock()
+
+	if pending.replied {
+		return
+	}
+	log.Printf("PC %s did not reply to command '%s' of session %s\n", remotePc.key, pending.cmd, pending.user.sessionId)
+	pending.user.sendCmdResponseError(pending.id, pending.cmd, "PC did not reply in time", Timeout)
+}
+
+// cancelCommands forgets the commands of the user, or of every user if nil
+func (remotePc *RemotePC) cancelCommands(user *User) {
+	remotePc.pendingMutex.Lock()
+	defer remotePc.pendingMutex.Unlock()
+
+	for _, pending := range remotePc.pending {
+		if user == nil || pending.user == user {
+			remotePc.forgetCommand(pending)
+		}
+	}
+}
+
+// isLastReply returns true if the PC says it won't send anything else for the command
+func isLastReply(msg message) bool {
+	if msg.Type == errorType {
+		return true
+	}
+
+	var reply struct {
+		Final bool `json:"final"`
+	}
+	msg.decodePayload(&reply)
+	return reply.Final
+}
+
+/*
+routeReply sends a reply of the PC to the session that sent the command, returns false if msg isn't one
+
+Replies to commands that already ended (including the ones that timed out), or were never sent, are dropped
+*/
+func (remotePc *RemotePC) routeReply(msg message) bool {
+	if !strings.HasPrefix(msg.ID, wireIdPrefix) {
+		return false
+	}
+
+	pending := remotePc.commandReplied(msg.ID, isLastReply(msg))
+	if pending == nil {
+		log.Printf("Dropping reply of PC %s to unknown request %s\n", remotePc.key, msg.ID)
+		return true
+	}
+
+	msg.ID, msg.Session = pending.id, pending.user.sessionId
+	remotePc.sendToSession(pending.user, func(user *User) { sendMessage(user, msg) })
+	return true
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandRequests(t *testing.T) {
+	defer func(timeout time.Duration) { commandTimeout = timeout }(commandTimeout)
+	commandTimeout = 500 * time.Millisecond
+
+	store := NewMemoryStore()
+	if err := setup(store); err != nil {
+		panic(err.Error())
+	}
+
+	wsController := NewWsController("admin", "admin", store, "")
+	server := httptest.NewServer(wsController.routes())
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	authHeader := http.Header{"X-Username": []string{"username"}, "X-Password": []string{"passwd"}}
+
+	wsPcConn, _, err := dialPC(wsURL+"/connect/"+key, authHeader, testHello("linux"))
+	assert.Nil(t, err)
+	defer wsPcConn.Close()
+
+	first, _, err := dialUser(wsURL+"/access/"+key, authHeader)
+	assert.Nil(t, err)
+	defer first.Close()
+	msg := make(Json)
+	assert.Nil(t, wsPcConn.ReadJSON(&msg))
+	firstSession := msg["session"].(string)
+
+	second, _, err := dialUser(wsURL+"/access/"+key, authHeader)
+	assert.Nil(t, err)
+	defer second.Close()
+	assert.Nil(t, wsPcConn.ReadJSON(&msg))
+	secondSession := msg["session"].(string)
+
+	// the PC gets the command with an ID assigned by the server
+	ls := Json{"type": "command", "id": "ls-1", "cmd": "ls_dir", "args": []interface{}{"/home/test"}}
+	assert.Nil(t, first.WriteJSON(ls))
+	msg = make(Json)
+	assert.Nil(t, wsPcConn.ReadJSON(&msg))
+	assert.Equal(t, "#1", msg["id"])
+	assert.Equal(t, firstSession, msg["session"])
+
+	// IDs can't be reused while the command is outstanding, or be invalid
+	assert.Nil(t, first.WriteJSON(ls))
+	msg = make(Json)
+	assert.Nil(t, first.ReadJSON(&msg))
+	assert.Equal(t, "ls-1", msg["id"])
+	assert.Equal(t, float64(InvalidCommand), msg["error_code"])
+	assert.Equal(t, `request ID "ls-1" is already in use`, msg["error_msg"])
+
+	assert.Nil(t, first.WriteJSON(Json{"type": "command", "id": "#1", "cmd": "ls_dir", "args": []interface{}{"/home/test"}}))
+	msg = make(Json)
+	assert.Nil(t, first.ReadJSON(&msg))
+	assert.Equal(t, errRequestId.Error(), msg["error"])
+
+	// replies only go to the session that sent the command, with its ID
+	assert.Nil(t, wsPcConn.WriteJSON(Json{"id": "#1", "session": secondSession, "cmd": "ls_dir", "args": []interface{}{"/home/test"}, "files": []interface{}{}}))
+	msg = make(Json)
+	assert.Nil(t, first.ReadJSON(&msg))
+	assert.Equal(t, Json{"id": "ls-1", "session": firstSession, "cmd": "ls_dir", "args": []interface{}{"/home/test"}, "files": []interface{}{}}, msg)
+
+	// the ID is in use until the command ends, not only until its first reply
+	assert.Nil(t, first.WriteJSON(ls))
+	msg = make(Json)
+	assert.Nil(t, first.ReadJSON(&msg))
+	assert.Equal(t, `request ID "ls-1" is already in use`, msg["error_msg"])
+
+	assert.Nil(t, wsPcConn.WriteJSON(Json{"id": "#1", "final": true}))
+	msg = make(Json)
+	assert.Nil(t, first.ReadJSON(&msg))
+	assert.Equal(t, Json{"id": "ls-1", "session": firstSession, "final": true}, msg)
+
+	// a command can have many replies, each one gives the PC more time
+	assert.Nil(t, first.WriteJSON(Json{"type": "command", "id": "ls-1", "cmd": "ls_dir", "args": []interface{}{"/home/test"}}))
+	msg = make(Json)
+	assert.Nil(t, wsPcConn.ReadJSON(&msg))
+	assert.Equal(t, "#2", msg["id"])
+	for _, reply := range []Json{{"id": "#2", "chunk": 1}, {"id": "#2", "chunk": 2}, {"id": "#2", "chunk": 3, "final": true}} {
+		time.Sleep(commandTimeout * 3 / 5)
+		assert.Nil(t, wsPcConn.WriteJSON(reply))
+		msg = make(Json)
+		assert.Nil(t, first.ReadJSON(&msg))
+		assert.Equal(t, "ls-1", msg["id"])
+		assert.Equal(t, reply["chunk"], int(msg["chunk"].(float64)))
+	}
+
+	// commands without an ID get the wire ID
+	assert.Nil(t, second.WriteJSON(Json{"type": "command", "cmd": "ls_dir", "args": []interface{}{"/home/test"}}))
+	msg = make(Json)
+	assert.Nil(t, wsPcConn.ReadJSON(&msg))
+	assert.Equal(t, "#3", msg["id"])
+
+	// the PC doesn't reply in time
+	start := time.Now()
+	msg = make(Json)
+	assert.Nil(t, second.ReadJSON(&msg))
+	assert.True(t, time.Since(start) > commandTimeout/2)
+	assert.Equal(t, "#3", msg["id"])
+	assert.Equal(t, "ls_dir", msg["cmd_response"])
+	assert.Equal(t, float64(Timeout), msg["error_code"])
+
+	// replies after the command ended are dropped
+	assert.Nil(t, wsPcConn.WriteJSON(Json{"id": "#1", "session": firstSession, "files": []interface{}{}}))
+	assert.Nil(t, wsPcConn.WriteJSON(Json{"id": "#2", "session": firstSession, "chunk": 4}))
+	assert.Nil(t, wsPcConn.WriteJSON(Json{"id": "#3", "session": secondSession, "files": []interface{}{}}))
+	assert.Nil(t, wsPcConn.WriteJSON(Json{"event": "locked"}))
+	for _, userConn := range []interface{ ReadJSON(interface{}) error }{first, second} {
+		msg = make(Json)
+		assert.Nil(t, userConn.ReadJSON(&msg))
+		assert.Equal(t, Json{"event": "locked"}, msg)
+	}
+
+	// binary replies, and replies with only the session, are replies to the commands of the session
+	assert.Nil(t, first.WriteJSON(Json{"type": "command", "id": "binary", "cmd": "ls_dir", "args": []interface{}{"/home/test"}}))
+	assert.Nil(t, wsPcConn.ReadJSON(&msg))
+	assert.Nil(t, second.WriteJSON(Json{"type": "command", "id": "no-id", "cmd": "ls_dir", "args": []interface{}{"/home/test"}}))
+	assert.Nil(t, wsPcConn.ReadJSON(&msg))
+	assert.Nil(t, wsPcConn.WriteMessage(websocket.BinaryMessage, sessionFrame(firstSession, []byte("file data"))))
+	assert.Nil(t, wsPcConn.WriteJSON(Json{"session": secondSession, "files": []interface{}{}}))
+
+	msgType, data, err := first.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, websocket.BinaryMessage, msgType)
+	assert.Equal(t, "file data", string(data))
+	msg = make(Json)
+	assert.Nil(t, second.ReadJSON(&msg))
+	assert.Equal(t, Json{"session": secondSession, "files": []interface{}{}}, msg)
+
+	// no Timeout error once they ended
+	time.Sleep(commandTimeout * 3 / 2)
+	assert.Nil(t, wsPcConn.WriteJSON(Json{"event": "locked"}))
+	for _, userConn := range []interface{ ReadJSON(interface{}) error }{first, second} {
+		msg = make(Json)
+		assert.Nil(t, userConn.ReadJSON(&msg))
+		assert.Equal(t, Json{"event": "locked"}, msg)
+	}
+
+	// a session can only have maxPendingCommands waiting for the PC
+	defer func(limit int) { maxPendingCommands = limit }(maxPendingCommands)
+	maxPendingCommands = 1
+	assert.Nil(t, second.WriteJSON(Json{"type": "command", "cmd": "ls_dir", "args": []interface{}{"/home/test"}}))
+	assert.Nil(t, wsPcConn.ReadJSON(&msg))
+	assert.Nil(t, second.WriteJSON(Json{"type": "command", "id": "ls-2", "cmd": "ls_dir", "args": []interface{}{"/home/test"}}))
+	msg = make(Json)
+	assert.Nil(t, second.ReadJSON(&msg))
+	assert.Equal(t, "ls-2", msg["id"])
+	assert.Equal(t, float64(TooManyCommands), msg["error_code"])
+	assert.Equal(t, errTooManyCommands.Error(), msg["error_msg"])
+
+	// outstanding commands of a session are forgotten when it disconnects
+	second.Close()
+	assert.Nil(t, wsPcConn.ReadJSON(&msg))
+	assert.Equal(t, float64(codeUserDisconnected), msg["code"])
+	remotePc := wsController.remotePcs.get(key)
+	remotePc.pendingMutex.Lock()
+	assert.Len(t, remotePc.pending, 0)
+	assert.Len(t, remotePc.sessionPending, 0)
+	remotePc.pendingMutex.Unlock()
+}
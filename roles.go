@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const permissionsChangedReason = "Permissions changed"
+
+/*
+effectivePermissions - what a user can do, merging its own permissions with the ones of its roles
+
+The user's own rule for a command overrides the roles. Otherwise a command listed
+by any role is allowed if at least one of them allows it
+*/
+type effectivePermissions struct {
+	user  Permissions
+	roles []rolePermissions
+}
+
+type rolePermissions struct {
+	name string
+	Permissions
+}
+
+func (permissions effectivePermissions) allows(request permissionRequest) bool {
+	return permissions.decide(request).Allow
+}
+
+func (permissions effectivePermissions) decide(request permissionRequest) permissionDecision {
+	if _, found := permissions.user.rule(request.cmd); found {
+		decision := permissions.user.decide(request)
+		decision.Source = "user"
+		return decision
+	}
+
+	var denied *permissionDecision
+	for _, role := range permissions.roles {
+		if _, found := role.rule(request.cmd); !found {
+			continue
+		}
+
+		decision := role.decide(request)
+		decision.Source = "role:" + role.name
+		if decision.Allow {
+			return decision
+		}
+		if denied == nil {
+			denied = &decision
+		}
+	}
+
+	if denied != nil {
+		return *denied
+	}
+	return unruledDecision(request.cmd)
+}
+
+// sourcedRule - a rule and where it comes from, user or role:<name>
+type sourcedRule struct {
+	Source string `json:"source"`
+	CommandRule
+}
+
+/*
+rules returns, for each command with a rule, the rules that decide it: the user's own,
+or the ones of every role listing it (one of them allowing is enough).
+Registered commands without rules are allowed unless default_allow is false, when a stored document couldn't be read
+*/
+func (permissions effectivePermissions) rules() Json {
+	commands := make(map[string][]sourcedRule)
+	if permissions.user.denyAll {
+		return Json{"commands": commands, "default_allow": false}
+	}
+
+	defaultAllow := true
+	for _, role := range permissions.roles {
+		if role.denyAll {
+			defaultAllow = false
+			continue
+		}
+		for name, rule := range role.Commands {
+			if _, found := permissions.user.Commands[name]; !found {
+				commands[name] = append(commands[name], sourcedRule{"role:" + role.name, rule})
+			}
+		}
+	}
+
+	for name, rule := range permissions.user.Commands {
+		commands[name] = []sourcedRule{{"user", rule}}
+	}
+	return Json{"commands": commands, "default_allow": defaultAllow}
+}
+
+/*
+loadRoles decodes the permissions of each role
+
+A role that can't be read denies every command, so losing it never grants
+what it was restricting
+*/
+func loadRoles(username string, flavor pathFlavor, roles []string, store Store) []rolePermissions {
+	permissions := make([]rolePermissions, 0, len(roles))
+	for _, name := range roles {
+		role, err := store.FindRole(name)
+		if err != nil {
+			log.Printf("Failed to read role '%s' of user '%s', denying its commands. Error: %s", name, username, err.Error())
+			permissions = append(permissions, rolePermissions{name, Permissions{denyAll: true}})
+			continue
+		}
+		permissions = append(permissions, rolePermissions{name, decodePermissions(username, flavor, role.Permissions)})
+	}
+	return permissions
+}
+
+/*
+reloadPermissions reads again the permissions of the connected users that match
+
+Each session gets an info message (0xf9) with its new rules, or is closed if disconnect is set,
+so an admin removing rights can be sure nothing keeps running with the old ones.
+disconnect closes every session that matches, the new rules are not compared with the old ones
+(a change that only grants rights closes them too)
+*/
+func (wsController *WsController) reloadPermissions(match func(user *User) bool, disconnect bool) {
+	for _, remotePc := range wsController.remotePcs.all() {
+		for _, user := range remotePc.connectedUsers() {
+			if !match(user) {
+				continue
+			}
+
+			if disconnect {
+				log.Printf("Permissions changed, closing session %s of user '%s'", user.sessionId, user.username)
+				user.writer.close(websocket.ClosePolicyViolation, permissionsChangedReason)
+				continue
+			}
+
+			userRecord, err := wsController.store.FindUser(user.username, remotePc.key)
+			if err != nil {
+				log.Printf("Failed to reload permissions of user '%s', closing session %s. Error: %s", user.username, user.sessionId, err.Error())
+				user.writer.close(websocket.ClosePolicyViolation, permissionsChangedReason)
+				continue
+			}
+
+			user.loadPermissions(userRecord, wsController.store)
+			sendInfo(user, codePermissionsChanged, permissionsChangedReason, user.permissionRules())
+			log.Printf("Permissions of session %s updated", user.sessionId)
+		}
+	}
+}
+
+// closeSessions closes the sessions that match, used when the user they belong to can't use them anymore
+func (wsController *WsController) closeSessions(match func(user *User) bool, reason string) {
+	for _, remotePc := range wsController.remotePcs.all() {
+		for _, user := range remotePc.connectedUsers() {
+			if match(user) {
+				log.Printf("%s, closing session %s of user '%s'", reason, user.sessionId, user.username)
+				user.writer.close(websocket.ClosePolicyViolation, reason)
+			}
+		}
+	}
+}
+
+// readRoleRequest returns the role name, its validated permissions and the force_disconnect flag, or writes the error response
+func readRoleRequest(response http.ResponseWriter, req *http.Request) (string, Json, bool, bool) {
+	name := strings.TrimSpace(mux.Vars(req)["name"])
+	if len(name) == 0 {
+		writeJson(response, http.StatusBadRequest, Json{"error": "Invalid role name"})
+		return "", nil, false, false
+	}
+
+	jsonData, err := requestBodyToJson(req.Body)
+	if err != nil {
+		log.Printf("Error parsing json - %s", err.Error())
+		httpBadRequest(response)
+		return "", nil, false, false
+	}
+
+	permissions, ok := jsonData["permissions"].(Json)
+	if !ok {
+		log.Printf("Invalid request - permissions must be an object")
+		httpBadRequest(response)
+		return "", nil, false, false
+	}
+
+	if _, permErr := ParsePermissions(permissions); permErr != nil {
+		log.Printf("Invalid request - %s", permErr.Error())
+		writeJson(response, http.StatusBadRequest, Json{"error": "Invalid permissions", "fields": permErr})
+		return "", nil, false, false
+	}
+
+	disconnect, _ := jsonData["force_disconnect"].(bool)
+	return name, permissions, disconnect, true
+}
+
+func (wsController *WsController) createRole() http.HandlerFunc {
+	return func(response http.ResponseWriter, req *http.Request) {
+		name, permissions, _, ok := readRoleRequest(response, req)
+		if !ok {
+			return
+		}
+
+		if _, err := wsController.store.FindRole(name); err != ErrNotFound {
+			if err != nil {
+				log.Printf("Failed to create role. Error: %s", err.Error())
+				response.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writeJson(response, http.StatusBadRequest, Json{"error": fmt.Sprintf("Role '%s' already exists", name)})
+			return
+		}
+
+		if err := wsController.store.InsertRole(&RoleRecord{Name: name, Permissions: permissions}); err != nil {
+			log.Printf("Failed to create role. Error: %s", err.Error())
+			response.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		response.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (wsController *WsController) setRolePermissions() http.HandlerFunc {
+	return func(response http.ResponseWriter, req *http.Request) {
+		name, permissions, disconnect, ok := readRoleRequest(response, req)
+		if !ok {
+			return
+		}
+
+		err := wsController.store.SetRolePermissions(name, permissions)
+		if err == ErrNotFound {
+			writeJson(response, http.StatusNotFound, Json{"error": fmt.Sprintf("Role '%s' not found", name)})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to set role permissions. Error: %s", err.Error())
+			response.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		wsController.reloadPermissions(func(user *User) bool { return user.hasRole(name) }, disconnect)
+		response.WriteHeader(http.StatusOK)
+	}
+}
+
+func (wsController *WsController) setUserRoles() http.HandlerFunc {
+	return func(response http.ResponseWriter, req *http.Request) {
+		jsonData, err := requestBodyToJson(req.Body)
+		if err != nil {
+			log.Printf("Error parsing json - %s", err.Error())
+			httpBadRequest(response)
+			return
+		}
+
+		username, okUsername := jsonData["username"].(string)
+		values, okRoles := jsonData["roles"].([]interface{})
+		if !okUsername || !okRoles {
+			log.Printf("Invalid request - username must be a string and roles an array")
+			httpBadRequest(response)
+			return
+		}
+
+		roles := make([]string, len(values))
+		for i, value := range values {
+			name, ok := value.(string)
+			if !ok {
+				httpBadRequest(response)
+				return
+			}
+			if _, err := wsController.store.FindRole(name); err != nil {
+				writeJson(response, http.StatusBadRequest, Json{"error": fmt.Sprintf("Role '%s' not found", name)})
+				return
+			}
+			roles[i] = name
+		}
+
+		pcKey := mux.Vars(req)["key"]
+		if err := wsController.store.SetUserRoles(username, pcKey, roles); err != nil {
+			log.Printf("Failed to set user roles. Error: %s", err.Error())
+			response.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		disconnect, _ := jsonData["force_disconnect"].(bool)
+		wsController.reloadPermissions(userSessions(username, pcKey), disconnect)
+		response.WriteHeader(http.StatusOK)
+	}
+}
+
+// userSessions matches the sessions of a user on a PC
+func userSessions(username, pcKey string) func(user *User) bool {
+	return func(user *User) bool {
+		return user.username == username && user.remotePc.key == pcKey
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// roleFixture returns a store with two roles and a user that has both, overriding delete_file
+func roleFixture() (Store, *UserRecord) {
+	store := NewMemoryStore()
+	store.InsertRole(&RoleRecord{Name: "home", Permissions: Json{"commands": Json{
+		"ls_dir":      Json{"allow": false, "restrictions": []interface{}{Json{"path": "${home}", "allow": true}}},
+		"delete_file": Json{"allow": false},
+	}}})
+	store.InsertRole(&RoleRecord{Name: "logs", Permissions: Json{"commands": Json{
+		"ls_dir": Json{"allow": false, "restrictions": []interface{}{Json{"path": "/var/log", "allow": true}}},
+	}}})
+
+	return store, &UserRecord{
+		Username:    "alice",
+		Permissions: Json{"commands": Json{"delete_file": Json{"allow": true}}},
+		Roles:       []string{"home", "logs"},
+	}
+}
+
+func TestEffectivePermissions(t *testing.T) {
+	store, userRecord := roleFixture()
+	user := NewUser(userRecord, nil, false)
+	user.loadPermissions(userRecord, store)
+
+	tests := []struct {
+		cmd   string
+		path  string
+		allow bool
+	}{
+		{"ls_dir", "/home/alice", true}, // any role allows it
+		{"ls_dir", "/var/log/nginx", true},
+		{"ls_dir", "/etc", false},
+		{"delete_file", "/etc/file", true}, // the user rule overrides the role
+		{"download_file", "/etc/file", true},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.allow, user.havePermission(test.cmd, []interface{}{test.path}), "%s %s", test.cmd, test.path)
+	}
+
+	// a role that can't be found denies its commands, other roles still apply
+	user.loadPermissions(&UserRecord{Username: "alice", Roles: []string{"logs", "removed"}}, store)
+	assert.False(t, user.havePermission("download_file", []interface{}{"/etc/file"}))
+	assert.True(t, user.havePermission("ls_dir", []interface{}{"/var/log"}))
+}
+
+func TestPermissionRules(t *testing.T) {
+	store, userRecord := roleFixture()
+	user := NewUser(userRecord, nil, false)
+	user.loadPermissions(userRecord, store)
+
+	rules := user.permissionRules()
+	assert.Equal(t, true, rules["default_allow"])
+	assert.Equal(t, map[string][]sourcedRule{
+		"ls_dir": {
+			{"role:home", CommandRule{Allow: false, Restrictions: []PathRestriction{{Path: "/home/alice", Allow: true}}}},
+			{"role:logs", CommandRule{Allow: false, Restrictions: []PathRestriction{{Path: "/var/log", Allow: true}}}},
+		},
+		"delete_file": {{"user", CommandRule{Allow: true}}},
+	}, rules["commands"])
+
+	// commands without rules are denied by a role that can't be read
+	userRecord.Roles = []string{"logs", "removed"}
+	user.loadPermissions(userRecord, store)
+	assert.Equal(t, false, user.permissionRules()["default_allow"])
+
+	observer := NewUser(userRecord, nil, true)
+	observer.loadPermissions(userRecord, store)
+	assert.Equal(t, Json{"commands": Json{}, "default_allow": false}, observer.permissionRules())
+}
+
+func TestRoles(t *testing.T) {
+	store := NewMemoryStore()
+	if err := setup(store); err != nil {
+		panic(err.Error())
+	}
+
+	wsController := NewWsController("admin", "admin", store, "")
+	server := httptest.NewServer(wsController.routes())
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	authHeader := http.Header{"X-Username": []string{"username"}, "X-Password": []string{"passwd"}}
+	adminHeader := http.Header{
+		"X-Username": []string{fmt.Sprintf("%x", sha256.Sum256([]byte("admin")))},
+		"X-Password": []string{fmt.Sprintf("%x", sha256.Sum256([]byte("admin")))},
+	}
+
+	denyRename := Json{"commands": Json{"rename_file": Json{"allow": false}}}
+	resp, _ := postJson(t, server.URL+"/create_role/operator", adminHeader, Json{"permissions": denyRename})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, body := postJson(t, server.URL+"/create_role/operator", adminHeader, Json{"permissions": denyRename})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "Role 'operator' already exists", body["error"])
+
+	// roles are shared by every PC, an admin token for a single PC can't change them
+	_, tokens := postJson(t, server.URL+"/login", nil, Json{"role": RoleAdmin, "username": adminHeader.Get("X-Username"), "password": adminHeader.Get("X-Password"), "key": key})
+	pcAdmin := http.Header{"Authorization": []string{"Bearer " + tokens["access_token"].(string)}}
+	resp, _ = postJson(t, server.URL+"/set_role_permissions/operator", pcAdmin, Json{"permissions": Json{}})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, body = postJson(t, server.URL+"/create_role/other", adminHeader, Json{"permissions": Json{"commands": Json{"rename_file": true}}})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "Invalid permissions", body["error"])
+
+	resp, body = postJson(t, server.URL+"/set_user_roles/"+key, adminHeader, Json{"username": "username", "roles": []interface{}{"operator", "other"}})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "Role 'other' not found", body["error"])
+
+	resp, _ = postJson(t, server.URL+"/set_role_permissions/other", adminHeader, Json{"permissions": denyRename})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = postJson(t, server.URL+"/set_user_roles/"+key, adminHeader, Json{"username": "username", "roles": []interface{}{"operator"}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	wsPcConn, _, err := dialPC(wsURL+"/connect/"+key, authHeader, nil)
+	assert.Nil(t, err)
+	defer wsPcConn.Close()
+	userConn, _, err := dialUser(wsURL+"/access/"+key, authHeader)
+	assert.Nil(t, err)
+	defer userConn.Close()
+
+	info := make(Json)
+	assert.Nil(t, wsPcConn.ReadJSON(&info))
+
+	rename := Json{"type": "command", "cmd": "rename_file", "args": []interface{}{"/srv/file", "/srv/other"}}
+	assertDenied := func() {
+		assert.Nil(t, userConn.WriteJSON(rename))
+		msg := make(Json)
+		assert.Nil(t, userConn.ReadJSON(&msg))
+		assert.Equal(t, float64(PermissionDenied), msg["error_code"])
+	}
+	assertAllowed := func() {
+		assert.Nil(t, userConn.WriteJSON(rename))
+		msg := make(Json)
+		wsPcConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		assert.Nil(t, wsPcConn.ReadJSON(&msg))
+		assert.Equal(t, "rename_file", msg["cmd"])
+	}
+
+	assertNotice := func() {
+		notice := make(Json)
+		assert.Nil(t, userConn.ReadJSON(&notice))
+		assert.Equal(t, float64(0xf9), notice["code"])
+	}
+
+	assertDenied()
+
+	// the user can ask for its rules
+	assert.Nil(t, userConn.WriteJSON(Json{"type": "info", "info": "permissions"}))
+	rules := make(Json)
+	assert.Nil(t, userConn.ReadJSON(&rules))
+	assert.Equal(t, float64(0xf8), rules["code"])
+	assert.Equal(t, Json{
+		"commands": Json{
+			"ls_dir":        []interface{}{Json{"source": "user", "allow": false, "restrictions": []interface{}{Json{"path": "/home/test", "allow": true}}}},
+			"download_file": []interface{}{Json{"source": "user", "allow": true, "restrictions": []interface{}{Json{"path": "/home/test", "allow": false, "allow_subdir": true}}}},
+			"delete_file":   []interface{}{Json{"source": "user", "allow": false, "restrictions": []interface{}{Json{"path": "/home/test/some/dir", "allow": true, "allow_subdir": true}}}},
+			"rename_file":   []interface{}{Json{"source": "role:operator", "allow": false}},
+		},
+		"default_allow": true,
+	}, rules["data"])
+
+	// other info requests still go to the PC
+	assert.Nil(t, userConn.WriteJSON(Json{"type": "info", "info": "system"}))
+	msg := make(Json)
+	assert.Nil(t, wsPcConn.ReadJSON(&msg))
+	assert.Equal(t, "system", msg["info"])
+
+	// changes to the role apply to connected users
+	resp, _ = postJson(t, server.URL+"/set_role_permissions/operator", adminHeader, Json{"permissions": Json{"commands": Json{
+		"rename_file": Json{"allow": false, "restrictions": []interface{}{Json{"path": "/srv", "allow": true}}},
+	}}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assertNotice()
+	assertAllowed()
+
+	resp, _ = postJson(t, server.URL+"/set_role_permissions/operator", adminHeader, Json{"permissions": denyRename})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assertNotice()
+	assertDenied()
+
+	// and so do the roles assigned to them
+	resp, _ = postJson(t, server.URL+"/set_user_roles/"+key, adminHeader, Json{"username": "username", "roles": []interface{}{}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assertNotice()
+	assertAllowed()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultShutdownDrain = 30 * time.Second
+	shutdownPollInterval = 100 * time.Millisecond
+	shutdownReason       = "Server shutting down"
+)
+
+func (wsController *WsController) shuttingDown() bool {
+	select {
+	case <-wsController.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+Shutdown drains the connected PCs and users, it must be called only once
+
+New PCs and users are refused right away, the connected ones are told the server
+is shutting down (info 0xfa, data is the drain period in seconds) and get up to
+drain to finish what they are doing. When every user leaves or the drain period
+ends, everyone is closed with CloseGoingAway
+*/
+func (wsController *WsController) Shutdown(drain time.Duration) {
+	close(wsController.shutdown)
+
+	pcs := wsController.remotePcs.all()
+	log.Printf("Shutting down, draining %d PCs for up to %s\n", len(pcs), drain)
+
+	for _, remotePc := range pcs {
+		sendInfo(remotePc, codeShutdown, shutdownReason, int(drain.Seconds()))
+		for _, user := range remotePc.connectedUsers() {
+			sendInfo(user, codeShutdown, shutdownReason, int(drain.Seconds()))
+		}
+	}
+
+	waitUntil(time.Now().Add(drain), func() bool {
+		for _, remotePc := range wsController.remotePcs.all() {
+			if remotePc.sessionCount() > 0 {
+				return false
+			}
+		}
+		return true
+	})
+
+	for _, remotePc := range wsController.remotePcs.all() {
+		remotePc.disconnectUsers(websocket.CloseGoingAway, shutdownReason)
+		remotePc.writer.close(websocket.CloseGoingAway, shutdownReason)
+	}
+
+	// the PCs are removed when they answer the close message
+	waitUntil(time.Now().Add(closeGracePeriod), func() bool {
+		return len(wsController.remotePcs.all()) == 0
+	})
+}
+
+func waitUntil(deadline time.Time, done func() bool) {
+	for !done() && time.Now().Before(deadline) {
+		time.Sleep(shutdownPollInterval)
+	}
+}
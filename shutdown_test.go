@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdown(t *testing.T) {
+	authHeader := http.Header{"X-Username": []string{"username"}, "X-Password": []string{"passwd"}}
+
+	// starts a server with a connected PC and user
+	start := func() (*WsController, string, *websocket.Conn, *websocket.Conn, func()) {
+		store := NewMemoryStore()
+		if err := setup(store); err != nil {
+			panic(err.Error())
+		}
+
+		wsController := NewWsController("test", "test", store, "")
+		server := httptest.NewServer(wsController.routes())
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+		wsPcConn, _, err := dialPC(wsURL+"/connect/"+key, authHeader, nil)
+		assert.Nil(t, err)
+		userConn, _, err := dialUser(wsURL+"/access/"+key, authHeader)
+		assert.Nil(t, err)
+
+		info := make(Json)
+		assert.Nil(t, wsPcConn.ReadJSON(&info))
+		assert.Equal(t, float64(0xfc), info["code"])
+
+		return wsController, wsURL, wsPcConn, userConn, func() {
+			wsPcConn.Close()
+			userConn.Close()
+			server.Close()
+		}
+	}
+
+	assertNotice := func(conn *websocket.Conn) {
+		notice := make(Json)
+		assert.Nil(t, conn.ReadJSON(&notice))
+		assert.Equal(t, float64(0xfa), notice["code"])
+	}
+
+	t.Run("DrainPeriod", func(t *testing.T) {
+		wsController, wsURL, wsPcConn, userConn, closeAll := start()
+		defer closeAll()
+
+		done := make(chan struct{})
+		started := time.Now()
+		go func() {
+			wsController.Shutdown(time.Second)
+			close(done)
+		}()
+
+		assertNotice(wsPcConn)
+		assertNotice(userConn)
+
+		// nobody else can connect
+		_, response, err := dialUser(wsURL+"/access/"+key, authHeader)
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+		_, response, err = websocket.DefaultDialer.Dial(wsURL+"/connect/other", authHeader)
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+
+		// the connected ones still work until the drain period ends
+		assert.Nil(t, wsPcConn.WriteJSON(Json{"data": "still here"}))
+		msg := make(Json)
+		assert.Nil(t, userConn.ReadJSON(&msg))
+		assert.Equal(t, "still here", msg["data"])
+
+		_, _, err = userConn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+		_, _, err = wsPcConn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+		assert.True(t, time.Since(started) >= time.Second)
+
+		<-done
+		assert.Empty(t, wsController.remotePcs.all())
+	})
+
+	t.Run("UsersLeaveEarly", func(t *testing.T) {
+		wsController, _, wsPcConn, userConn, closeAll := start()
+		defer closeAll()
+
+		done := make(chan struct{})
+		go func() {
+			wsController.Shutdown(time.Minute)
+			close(done)
+		}()
+
+		assertNotice(userConn)
+		userConn.Close()
+
+		select {
+		case <-done:
+			t.Error("the PC didn't answer the close message yet")
+		case <-time.After(500 * time.Millisecond):
+		}
+
+		for {
+			if _, _, err := wsPcConn.ReadMessage(); err != nil {
+				assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+				break
+			}
+		}
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("shutdown must end when every user leaves")
+		}
+	})
+}
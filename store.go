@@ -0,0 +1,57 @@
+package main
+
+import "errors"
+
+// ErrNotFound is returned by a Store when the requested PC or user does not exist
+var ErrNotFound = errors.New("not found")
+
+// PCRecord - a registered remote PC
+type PCRecord struct {
+	Key      string `bson:"key"`
+	Username string `bson:"username"`
+	Password string `bson:"password"` // bcrypt hash
+}
+
+// UserRecord - a user that can access the PC identified by PcKey
+type UserRecord struct {
+	Username    string   `bson:"username"`
+	Password    string   `bson:"password"` // bcrypt hash
+	PcKey       string   `bson:"pc_key"`
+	Permissions Json     `bson:"permissions"` // overrides the permissions of the roles
+	Roles       []string `bson:"roles,omitempty"`
+
+	ObserverOnly bool        `bson:"observer_only"`    // can only connect as an observer
+	Access       *UserAccess `bson:"access,omitempty"` // when the user can connect, any time if nil
+}
+
+// RoleRecord - permissions shared by every user assigned to the role
+type RoleRecord struct {
+	Name        string `bson:"name"`
+	Permissions Json   `bson:"permissions"`
+}
+
+/*
+Store - persistence for PCs, users, user permissions and roles
+
+Implementations must be safe for concurrent use
+*/
+type Store interface {
+	FindPC(key string) (*PCRecord, error)
+	InsertPC(pc *PCRecord) error
+	SetPCPassword(key, password string) error
+
+	FindUser(username, pcKey string) (*UserRecord, error)
+	InsertUser(user *UserRecord) error
+	SetUserPassword(username, pcKey, password string) error
+	SetUserPermissions(username, pcKey string, permissions Json) error
+	SetUserObserverOnly(username, pcKey string, observerOnly bool) error
+	SetUserAccess(username, pcKey string, access *UserAccess) error
+	SetUserRoles(username, pcKey string, roles []string) error
+	DeleteUser(username, pcKey string) error
+
+	FindRole(name string) (*RoleRecord, error)
+	InsertRole(role *RoleRecord) error
+	SetRolePermissions(name string, permissions Json) error
+
+	Close() error
+}
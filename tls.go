@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const certReloadInterval = 10 * time.Second
+
+// TLSSettings - where the certificate is and which protocol versions and ciphers are accepted
+type TLSSettings struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	MinVersion   string `yaml:"min_version"`   // 1.2 or 1.3
+	CipherPolicy string `yaml:"ciphers"`       // modern (ECDHE + AEAD only) or compatible (Go defaults)
+	RedirectPort string `yaml:"redirect_port"` // plain HTTP port redirected to HTTPS, empty to disable
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLS 1.3 ciphers can't be configured, these apply to TLS 1.2
+var modernCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+/*
+certReloader - serves the certificate loaded from disk
+
+The files are checked every certReloadInterval and loaded again when they change,
+if the new files are invalid (e.g. the key was written but not the certificate yet)
+the current certificate is kept
+*/
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile, done: make(chan struct{})}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// lastModified returns the most recent modification time of the certificate and key
+func (reloader *certReloader) lastModified() (time.Time, error) {
+	var modTime time.Time
+	for _, file := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTime, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+func (reloader *certReloader) reload() error {
+	modTime, err := reloader.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+
+	reloader.mutex.Lock()
+	reloader.cert = &cert
+	reloader.modTime = modTime
+	reloader.mutex.Unlock()
+	return nil
+}
+
+// reloadIfChanged loads the certificate again if the files changed since the last load
+func (reloader *certReloader) reloadIfChanged() {
+	modTime, err := reloader.lastModified()
+	if err != nil {
+		log.Printf("Failed to check TLS certificate\nError: %s\n", err.Error())
+		return
+	}
+
+	reloader.mutex.RLock()
+	changed := !modTime.Equal(reloader.modTime)
+	reloader.mutex.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	if err := reloader.reload(); err != nil {
+		log.Printf("Failed to reload TLS certificate, keeping the current one\nError: %s\n", err.Error())
+		return
+	}
+	log.Printf("TLS certificate reloaded")
+}
+
+func (reloader *certReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reloader.reloadIfChanged()
+		case <-reloader.done:
+			return
+		}
+	}
+}
+
+func (reloader *certReloader) stop() {
+	reloader.stopOnce.Do(func() { close(reloader.done) })
+}
+
+func (reloader *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+	return reloader.cert, nil
+}
+
+// newTLSConfig loads the certificate and starts watching its files, stop the reloader when done
+func newTLSConfig(settings TLSSettings) (*tls.Config, *certReloader, error) {
+	minVersion, found := tlsVersions[settings.MinVersion]
+	if !found {
+		return nil, nil, fmt.Errorf("invalid TLS minimum version: %s (must be 1.2 or 1.3)", settings.MinVersion)
+	}
+
+	var cipherSuites []uint16
+	switch settings.CipherPolicy {
+	case "modern":
+		cipherSuites = modernCipherSuites
+	case "compatible":
+	default:
+		return nil, nil, fmt.Errorf("invalid TLS cipher policy: %s (must be modern or compatible)", settings.CipherPolicy)
+	}
+
+	reloader, err := newCertReloader(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	go reloader.watch(certReloadInterval)
+
+	return &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		GetCertificate: reloader.getCertificate,
+	}, reloader, nil
+}
+
+// httpsRedirect redirects every request to the same host and path on httpsPort
+func httpsRedirect(httpsPort string) http.HandlerFunc {
+	return func(response http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		} else {
+			host = strings.Trim(host, "[]")
+		}
+
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]" // IPv6
+		}
+
+		http.Redirect(response, req, "https://"+host+req.URL.RequestURI(), http.StatusPermanentRedirect) // keeps the method and body of POST requests
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCert writes a self-signed certificate and its key
+func writeCert(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	assert.Nil(t, os.Chtimes(certFile, modTime, modTime))
+	assert.Nil(t, os.Chtimes(keyFile, modTime, modTime))
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+
+	commonName := func(reloader *certReloader) string {
+		cert, err := reloader.getCertificate(&tls.ClientHelloInfo{})
+		assert.Nil(t, err)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		assert.Nil(t, err)
+		return parsed.Subject.CommonName
+	}
+
+	_, err := newCertReloader(certFile, keyFile)
+	assert.Error(t, err, "the files must exist")
+
+	writeCert(t, certFile, keyFile, "first", now)
+	reloader, err := newCertReloader(certFile, keyFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", commonName(reloader))
+
+	reloader.reloadIfChanged()
+	assert.Equal(t, "first", commonName(reloader))
+
+	writeCert(t, certFile, keyFile, "second", now.Add(time.Minute))
+	reloader.reloadIfChanged()
+	assert.Equal(t, "second", commonName(reloader))
+
+	// a broken certificate doesn't replace the current one
+	assert.Nil(t, os.WriteFile(certFile, []byte("not a certificate"), 0600))
+	assert.Nil(t, os.Chtimes(certFile, now.Add(2*time.Minute), now.Add(2*time.Minute)))
+	reloader.reloadIfChanged()
+	assert.Equal(t, "second", commonName(reloader))
+
+	// the watcher picks up changes by itself
+	go reloader.watch(10 * time.Millisecond)
+	defer reloader.stop()
+	writeCert(t, certFile, keyFile, "third", now.Add(3*time.Minute))
+	assert.Eventually(t, func() bool { return commonName(reloader) == "third" }, time.Second, 10*time.Millisecond)
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "localhost", time.Now())
+
+	settings := TLSSettings{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3", CipherPolicy: "modern"}
+	config, reloader, err := newTLSConfig(settings)
+	assert.Nil(t, err)
+	reloader.stop()
+	assert.Equal(t, uint16(tls.VersionTLS13), config.MinVersion)
+	assert.Equal(t, modernCipherSuites, config.CipherSuites)
+
+	settings.CipherPolicy = "compatible"
+	config, reloader, err = newTLSConfig(settings)
+	assert.Nil(t, err)
+	reloader.stop()
+	assert.Nil(t, config.CipherSuites)
+
+	settings.CipherPolicy = "weak"
+	_, _, err = newTLSConfig(settings)
+	assert.Error(t, err)
+
+	settings.CipherPolicy, settings.MinVersion = "modern", "1.0"
+	_, _, err = newTLSConfig(settings)
+	assert.Error(t, err)
+}
+
+func TestHttpsRedirect(t *testing.T) {
+	tests := []struct {
+		host      string
+		httpsPort string
+		location  string
+	}{
+		{"example.com", "443", "https://example.com/access/key?mode=observer"},
+		{"example.com:80", "443", "https://example.com/access/key?mode=observer"},
+		{"example.com:8080", "9002", "https://example.com:9002/access/key?mode=observer"},
+		{"[::1]:80", "443", "https://[::1]/access/key?mode=observer"},
+		{"[::1]", "9002", "https://[::1]:9002/access/key?mode=observer"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/access/key?mode=observer", nil)
+		req.Host = test.host
+		response := httptest.NewRecorder()
+
+		httpsRedirect(test.httpsPort)(response, req)
+		assert.Equal(t, http.StatusPermanentRedirect, response.Code, test.host)
+		assert.Equal(t, test.location, response.Header().Get("Location"), test.host)
+	}
+}
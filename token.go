@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	RoleAdmin = "admin"
+	RolePC    = "pc"
+	RoleUser  = "user"
+
+	AccessToken  = "access"
+	RefreshToken = "refresh"
+
+	// websocket clients that can't set headers send ["bearer", token] as subprotocols
+	tokenSubprotocol = "bearer"
+)
+
+// set from the configuration, see Config.apply
+var (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 24 * time.Hour
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+/*
+TokenClaims - what a token grants
+
+Stamp is derived from the password hash stored when the token was issued,
+changing the password or removing the account invalidates every token
+*/
+type TokenClaims struct {
+	Username  string `json:"sub"`
+	PcKey     string `json:"key,omitempty"` // empty for admin tokens valid on every PC
+	Role      string `json:"role"`
+	Type      string `json:"typ"`
+	Stamp     string `json:"stamp"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// TokenIssuer signs and verifies tokens with HMAC-SHA256
+type TokenIssuer struct {
+	secret []byte
+}
+
+// NewTokenIssuer creates a token issuer, with a random secret if none is given
+func NewTokenIssuer(secret string) (*TokenIssuer, error) {
+	if len(secret) > 0 {
+		return &TokenIssuer{[]byte(secret)}, nil
+	}
+
+	randomSecret := make([]byte, 32)
+	if _, err := rand.Read(randomSecret); err != nil {
+		return nil, err
+	}
+	return &TokenIssuer{randomSecret}, nil
+}
+
+func (issuer *TokenIssuer) sign(data string) string {
+	mac := hmac.New(sha256.New, issuer.secret)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// stamp ties a token to the credentials it was issued for
+func (issuer *TokenIssuer) stamp(storedPassword string) string {
+	return issuer.sign("stamp:" + storedPassword)[:16]
+}
+
+// Issue returns a signed token with the claims, valid for ttl
+func (issuer *TokenIssuer) Issue(claims TokenClaims, ttl time.Duration) (string, error) {
+	claims.ExpiresAt = time.Now().Add(ttl).Unix()
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + issuer.sign(payload), nil
+}
+
+// Parse checks the token signature and expiration and returns its claims
+func (issuer *TokenIssuer) Parse(token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidToken
+	}
+
+	if !hmac.Equal([]byte(parts[1]), []byte(issuer.sign(parts[0]))) {
+		return nil, ErrInvalidToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	claims := &TokenClaims{}
+	if err := json.Unmarshal(data, claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errors.New("token expired")
+	}
+
+	return claims, nil
+}
+
+// getAuthToken returns the token sent in the Authorization header or as a websocket subprotocol
+func getAuthToken(req *http.Request) string {
+	authorization := strings.TrimSpace(req.Header.Get("Authorization"))
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+
+	protocols := websocket.Subprotocols(req)
+	for i, protocol := range protocols {
+		if protocol == tokenSubprotocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+
+	return ""
+}
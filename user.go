@@ -1,18 +1,15 @@
 package main
 
 import (
-	"context"
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net/http"
-	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-
 	"github.com/gorilla/websocket"
 )
 
@@ -23,67 +20,131 @@ const (
 	InvalidArguments ErrorCode = 0x0B
 	InternalError    ErrorCode = 0x0C
 	InvalidCommand   ErrorCode = 0x0D
+	NotSupported     ErrorCode = 0x0E // the PC can't run the command
+	Timeout          ErrorCode = 0x0F // the PC didn't reply to the command in time
+	TooManyCommands  ErrorCode = 0x10 // the session has too many commands waiting for the PC, it can retry later
 )
 
-// check if its a valid request, and return the request type
-func validRequest(jsonRequest Json) (string, bool) {
-	requestType, found := jsonRequest["type"].(string)
-	if found {
-		if requestType == "info" || requestType == "command" || requestType == "error" {
-			return requestType, true
-		}
-	}
+/*
+Binary messages between a session and the PC start with binarySession and the session ID,
+the ones the PC sends to every user start with binaryBroadcast
+*/
+const (
+	sessionIdLength = 16
 
-	return "", false
-}
+	binaryBroadcast byte = 0x00
+	binarySession   byte = 0x01
+)
 
 type User struct {
-	username string
+	username  string
+	pcKey     string
+	sessionId string
+	observer  bool // observers receive everything the PC sends but can't send anything to it
+	version   int  // protocol version of the session
+
+	remotePc *RemotePC
+	paths    pathFlavor // how the PC writes its paths
+	wsConn   *websocket.Conn
+	writer   *connWriter // slow users are disconnected, so they don't hold back the PC
+
+	mutex       sync.Mutex // permissions and roles change while the session is connected
+	permissions effectivePermissions
+	roles       []string
+
+	access      *UserAccess
+	accessTimer *time.Timer // closes the session when the access ends
+}
 
-	remotePc    *RemotePC
-	wsConn      *websocket.Conn
-	collection  *mongo.Collection
-	userDoc     Json
-	permissions Json
+func (user *User) getWriter() *connWriter {
+	return user.writer
 }
 
-func (user *User) getConn() *websocket.Conn {
-	return user.wsConn
+func (user *User) protocol() int {
+	return user.version
 }
 
-// NewUser returns a user only if it exists
-func NewUser(username, password string, pc *RemotePC, db *mongo.Database) *User {
-	collection := db.Collection("users")
+// setConn sets the websocket connection of the user, after its upgraded
+func (user *User) setConn(wsConn *websocket.Conn) {
+	user.wsConn = wsConn
+	user.wsConn.SetReadLimit(maxMessageSize)
+	user.writer = newConnWriter(wsConn, Disconnect, outboundQueueSize)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+// AuthenticateUser returns the user record only if it exists and the password matches
+func AuthenticateUser(username, password, pcKey string, store Store) *UserRecord {
+	if len(username) == 0 || len(password) == 0 {
+		return nil
+	}
 
-	user := collection.FindOne(ctx, bson.M{"username": username, "password": password, "pc_key": pc.key})
+	userRecord, err := store.FindUser(username, pcKey)
 
-	doc := make(Json)
+	if err != nil {
+		log.Printf("User '%s' not found. Error: %s", username, err.Error())
+		return nil
+	}
 
-	if user.Err() != nil {
-		log.Printf("User '%s' with password '%s' not found. Error: %s", username, password, user.Err().Error())
+	valid, upgrade := checkPassword(userRecord.Password, password)
+	if !valid {
+		log.Printf("Invalid password for user '%s'", username)
 		return nil
 	}
 
-	err := user.Decode(&doc)
-	if err != nil {
-		log.Printf("Failed to decode user document. Error: %s", err.Error())
+	if upgrade {
+		// stored in plaintext by an older version, replace it with a hash
+		if hash, err := hashPassword(password); err == nil {
+			if err := store.SetUserPassword(username, pcKey, hash); err != nil {
+				log.Printf("Failed to upgrade password of user '%s'. Error: %s", username, err.Error())
+			}
+		}
+	}
+
+	return userRecord
+}
+
+// NewUser returns the user that will access (or only observe) the PC, with a new session ID
+func NewUser(userRecord *UserRecord, pc *RemotePC, observer bool) *User {
+	sessionId := make([]byte, sessionIdLength/2)
+	if _, err := rand.Read(sessionId); err != nil {
+		log.Printf("Failed to generate session ID. Error: %s", err.Error())
 		return nil
 	}
-	permissions := doc["permissions"].(Json)
 
-	return &User{username: username, remotePc: pc, collection: collection, userDoc: doc, permissions: permissions["commands"].(Json)}
+	paths := posixPaths
+	if pc != nil {
+		paths = pc.paths
+	}
+
+	return &User{
+		username:    userRecord.Username,
+		pcKey:       userRecord.PcKey,
+		sessionId:   hex.EncodeToString(sessionId),
+		observer:    observer,
+		remotePc:    pc,
+		paths:       paths,
+		permissions: effectivePermissions{user: decodePermissions(userRecord.Username, paths, userRecord.Permissions)},
+		roles:       userRecord.Roles,
+		access:      userRecord.Access,
+	}
 }
 
-//CreateUser registers a new user for the remote PC
-func CreateUser(userData Json, remotePcKey string, db *mongo.Database) RegisterError {
+// CreateUser registers a new user for the remote PC
+func CreateUser(userData Json, remotePcKey string, store Store) RegisterError {
 	if !jsonContainsKeys(userData, []string{"username", "password"}) {
 		return NewRegisterError(http.StatusBadRequest, "Invalid arguments")
 	}
 
-	collection := db.Collection("users")
+	username, okUsername := userData["username"].(string)
+	password, okPassword := userData["password"].(string)
+
+	if !okUsername || !okPassword {
+		return NewRegisterError(http.StatusBadRequest, "Invalid arguments")
+	}
+
+	// the username is used in restriction paths (${username}, ${home})
+	if !isPathComponent(username) {
+		return NewRegisterError(http.StatusBadRequest, `Invalid username, it can't be empty, "." or ".." or contain / or \`)
+	}
 
 	remotePcKey = strings.TrimSpace(remotePcKey)
 
@@ -91,29 +152,30 @@ func CreateUser(userData Json, remotePcKey string, db *mongo.Database) RegisterE
 		return NewRegisterError(http.StatusBadRequest, "Invalid PC key")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
 	//check if a PC with this key exists
-	findResult := db.Collection("pcs").FindOne(ctx, bson.M{"key": remotePcKey})
-	if findResult.Err() != nil {
+	if _, err := store.FindPC(remotePcKey); err != nil {
 		return NewRegisterError(http.StatusNotFound, fmt.Sprintf("Could not find a PC with key '%s'", remotePcKey))
 	}
 
-	ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	findResult = collection.FindOne(ctx, bson.M{"username": userData["username"], "pc_key": remotePcKey})
-
-	if findResult.Err() == nil {
+	if _, err := store.FindUser(username, remotePcKey); err != ErrNotFound {
+		if err != nil {
+			return NewRegisterError(http.StatusInternalServerError, err.Error())
+		}
 		//username already exists
-		return NewRegisterError(http.StatusBadRequest, fmt.Sprintf("Username '%s' already exists", userData["username"]))
+		return NewRegisterError(http.StatusBadRequest, fmt.Sprintf("Username '%s' already exists", username))
 	}
 
-	userData["pc_key"] = remotePcKey
-	userData["permissions"] = Json{"commands": Json{}}
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return NewRegisterError(http.StatusInternalServerError, "Failed to hash password")
+	}
 
-	_, err := collection.InsertOne(ctx, userData)
+	err = store.InsertUser(&UserRecord{
+		Username:    username,
+		Password:    passwordHash,
+		PcKey:       remotePcKey,
+		Permissions: Json{"commands": Json{}},
+	})
 
 	if err != nil {
 		return NewRegisterError(http.StatusInternalServerError, err.Error())
@@ -122,8 +184,92 @@ func CreateUser(userData Json, remotePcKey string, db *mongo.Database) RegisterE
 	return RegisterError{}
 }
 
+// loadPermissions sets the permissions of the user record merged with the ones of its roles
+func (user *User) loadPermissions(userRecord *UserRecord, store Store) {
+	permissions := effectivePermissions{
+		user:  decodePermissions(userRecord.Username, user.paths, userRecord.Permissions),
+		roles: loadRoles(userRecord.Username, user.paths, userRecord.Roles, store),
+	}
+
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	user.permissions, user.roles = permissions, userRecord.Roles
+}
+
+// permissionRules returns the rules the commands of the user are checked with, observers can't use any
+func (user *User) permissionRules() Json {
+	if user.observer {
+		return Json{"commands": Json{}, "default_allow": false}
+	}
+
+	user.mutex.Lock()
+	permissions := user.permissions
+	user.mutex.Unlock()
+	return permissions.rules()
+}
+
+func (user *User) hasRole(name string) bool {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+
+	for _, role := range user.roles {
+		if role == name {
+			return true
+		}
+	}
+	return false
+}
+
+// watchAccess closes the session when the user access ends
+func (user *User) watchAccess() {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+
+	if user.accessTimer != nil {
+		user.accessTimer.Stop()
+	}
+	ends := user.access.endsAt(time.Now())
+	if ends.IsZero() {
+		return
+	}
+	user.accessTimer = time.AfterFunc(time.Until(ends), user.accessEnded)
+}
+
+// setAccess replaces the access of a connected session, closing it if the user can't access the PC anymore
+func (user *User) setAccess(access *UserAccess) {
+	user.mutex.Lock()
+	user.access = access
+	user.mutex.Unlock()
+
+	user.accessEnded()
+}
+
+func (user *User) accessEnded() {
+	user.mutex.Lock()
+	access := user.access
+	user.mutex.Unlock()
+
+	if reason := access.check(time.Now()); reason != "" {
+		log.Printf("Closing session %s of user '%s': %s", user.sessionId, user.username, reason)
+		user.writer.close(websocket.ClosePolicyViolation, reason)
+		return
+	}
+	// the next window started right away
+	user.watchAccess()
+}
+
+func (user *User) stopWatchingAccess() {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+
+	if user.accessTimer != nil {
+		user.accessTimer.Stop()
+	}
+}
+
 func (user *User) readRoutine() {
-	defer user.remotePc.disconnectUser()
+	defer user.remotePc.disconnectUser(user)
+	defer user.stopWatchingAccess()
 
 	for {
 
@@ -139,155 +285,130 @@ func (user *User) readRoutine() {
 		}
 
 		if msgType == websocket.TextMessage {
-			var jsonData Json
-			err := json.Unmarshal(data, &jsonData)
-
+			msg, err := decodeMessage(user.version, data, userTypes)
+			if err == nil && msg.Type == dataType && (user.version < 2 || user.remotePc.protocol() < 2) {
+				err = checkUserData(msg)
+			}
 			if err != nil {
-				log.Printf("Failed to parse json data: %s\n", data)
+				log.Printf("Invalid message from session %s: %s\n", user.sessionId, err.Error())
+				sendError(user, err.Error())
 				continue
 			}
+			msg.Session = user.sessionId
 
-			requestType, ok := jsonData["type"].(string)
-
-			if !ok {
-				ClientWriteJSON(user.remotePc, jsonData)
+			if len(msg.ID) > 0 && !requestIdPattern.MatchString(msg.ID) {
+				sendError(user, errRequestId.Error())
 				continue
 			}
 
-			if requestType == "command" {
-
-				if !jsonContainsKeys(jsonData, []string{"cmd", "args"}) {
-					ClientWriteJSON(user, Json{"error": "Invalid request"})
-					continue
-				}
-
-				cmd, ok := jsonData["cmd"].(string)
-
-				if !ok {
-					user.sendCmdResponseError(cmd, "Invalid command", InvalidCommand)
-					continue
-				}
+			// answered by the server, other info requests go to the PC
+			var request infoRequestPayload
+			if msg.Type == infoType && msg.decodePayload(&request) == nil && request.Info == "permissions" {
+				sendInfo(user, codePermissions, "Permissions", user.permissionRules())
+				continue
+			}
 
-				requestArgs, ok := jsonData["args"].([]interface{})
+			if user.observer && msg.Type != commandType {
+				sendError(user, "Observer sessions are read-only")
+				continue
+			}
 
+			if msg.Type == commandType {
+				command, ok := user.readCommand(msg)
 				if !ok {
-					user.sendCmdResponseError(cmd, "Invalid arguments", InvalidArguments)
 					continue
 				}
-
-				log.Printf("Received command '%s' with args '%v'\n", cmd, requestArgs)
-				sanitizedArgs, errorCode := sanitizeRequestArgs(requestArgs)
-
-				if errorCode != 0 {
-					user.sendCmdResponseError(cmd, "Error", errorCode)
-				}
-
-				if len(sanitizedArgs) != len(requestArgs) {
-					break
-				}
-
-				jsonData["args"] = sanitizedArgs
-				if !user.havePermission(cmd, jsonData["args"].([]interface{})) {
-					log.Printf("User doesnt have permission to use command %s with args %s\n", cmd, jsonData["args"])
-					user.sendCmdResponseError(cmd, "Permission Denied", PermissionDenied)
+				wireId, err := user.remotePc.trackCommand(user, msg.ID, command.Cmd)
+				if err != nil {
+					code := InvalidCommand
+					if err == errTooManyCommands {
+						code = TooManyCommands
+					}
+					user.sendCmdResponseError(msg.ID, command.Cmd, err.Error(), code)
 					continue
 				}
+				msg.ID, msg.Payload = wireId, command
 			}
 
-			ClientWriteJSON(user.remotePc, jsonData)
+			sendMessage(user.remotePc, msg)
 			continue
 		}
-		ClientWrite(user.remotePc, msgType, data)
+		if user.observer {
+			sendError(user, "Observer sessions are read-only")
+			continue
+		}
+		ClientWrite(user.remotePc, msgType, sessionFrame(user.sessionId, data))
 	}
 }
 
-func (user *User) havePermission(cmd string, args []interface{}) bool {
-	// user have all permissions
-	if len(user.permissions) == 0 {
-		return true
-	}
-
-	if _, found := user.permissions[cmd]; found {
-		permission := user.permissions[cmd].(Json)
-		restrictions := permission["restrictions"].(bson.A)
-
-		if !permission["allow"].(bool) && len(restrictions) == 0 {
-			return false
-		}
+/*
+readCommand validates a command and its args, which are canonicalized, and checks the user can run it
 
-		// any command that interact with a file (download, delete etc...)
-
-		if len(restrictions) > 0 {
-			isFileCommand := cmd != "ls_dir"
-			for _, requestArg := range args {
-				arg, ok := requestArg.(string)
-
-				if !ok {
-					// if its not a string, just ignore it
-					continue
-				}
-
-				for _, res := range restrictions {
-					restriction := res.(Json)
-					restrictionPath := restriction["path"].(string)
+Any problem is sent to the user, false is returned then
+*/
+func (user *User) readCommand(msg message) (commandPayload, bool) {
+	var fields Json
+	if msg.decodePayload(&fields) != nil || !jsonContainsKeys(fields, []string{"cmd", "args"}) {
+		sendError(user, "Invalid request")
+		return commandPayload{}, false
+	}
 
-					if isFileCommand {
-						requestedPath := filepath.Clean(filepath.Dir(arg))
+	cmd, ok := fields["cmd"].(string)
 
-						if requestedPath == filepath.Clean(restrictionPath) {
-							return restriction["allow"].(bool)
-						}
+	if !ok {
+		user.sendCmdResponseError(msg.ID, cmd, "Invalid command", InvalidCommand)
+		return commandPayload{}, false
+	}
 
-						// check if its a subdirectory of the restricted path
-						if strings.Index(requestedPath, restrictionPath) == 0 {
-							allowSubDir, ok := restriction["allow_subdir"].(bool)
+	requestArgs, ok := fields["args"].([]interface{})
 
-							if !ok {
-								return true
-							}
+	if !ok {
+		user.sendCmdResponseError(msg.ID, cmd, "Invalid arguments", InvalidArguments)
+		return commandPayload{}, false
+	}
 
-							if !allowSubDir {
-								log.Printf("Command not allowed on subdir: %s", requestedPath)
-							}
+	log.Printf("Received command '%s' with args '%v'\n", cmd, requestArgs)
+	args, err := canonicalArgs(user.paths, cmd, requestArgs)
 
-							return allowSubDir
-						}
-					}
+	if err != nil {
+		user.sendCmdResponseError(msg.ID, cmd, "Invalid arguments: "+err.Error(), InvalidArguments)
+		return commandPayload{}, false
+	}
 
-					if strings.Index(arg, restrictionPath) == 0 {
-						return restriction["allow"].(bool)
-					}
-					continue
-				}
-			}
-			return permission["allow"].(bool)
-		}
+	if !user.havePermission(cmd, args) {
+		log.Printf("User doesnt have permission to use command %s with args %s\n", cmd, args)
+		user.sendCmdResponseError(msg.ID, cmd, "Permission Denied", PermissionDenied)
+		return commandPayload{}, false
+	}
 
+	if !user.remotePc.supports(cmd) {
+		user.sendCmdResponseError(msg.ID, cmd, "Command not supported by the PC", NotSupported)
+		return commandPayload{}, false
 	}
 
-	return true
+	return commandPayload{cmd, args}, true
 }
 
-func sanitizeRequestArgs(requestArgs []interface{}) ([]interface{}, ErrorCode) {
-	// sanitizedArgs := make([]string, len(requestArgs))
-	for i, arg := range requestArgs {
-		strArg, ok := arg.(string)
-		if !ok {
-			// // argument must be a string
-			continue
-		}
-
-		strArg = strings.ReplaceAll(strArg, `../`, "")
-		strArg = strings.ReplaceAll(strArg, `./`, "")
+func (user *User) havePermission(cmd string, args []interface{}) bool {
+	return user.checkPermission(cmd, args).Allow
+}
 
-		if len(strArg) > 0 {
-			requestArgs[i] = filepath.Clean(strArg)
-		}
+// checkPermission returns whether the user can use the command with the (already canonical) args, and why
+func (user *User) checkPermission(cmd string, args []interface{}) permissionDecision {
+	// observers can't use any command
+	if user.observer {
+		return permissionDecision{Allow: false, Reason: "Observer sessions are read-only"}
 	}
 
-	return requestArgs, 0
+	request := permissionRequest{cmd: cmd, args: args, username: user.username, pcKey: user.pcKey, time: time.Now(), paths: user.paths}
+
+	user.mutex.Lock()
+	permissions := user.permissions
+	user.mutex.Unlock()
+	return permissions.decide(request)
 }
 
-func (user *User) sendCmdResponseError(cmd, errorMsg string, errorCode ErrorCode) {
-	ClientWriteJSON(user, Json{"cmd_response": cmd, "error_code": errorCode, "error_msg": errorMsg})
+// sendCmdResponseError rejects the command with the request ID
+func (user *User) sendCmdResponseError(id, cmd, errorMsg string, errorCode ErrorCode) {
+	sendMessage(user, message{Type: commandErrorType, ID: id, Payload: commandErrorPayload{cmd, errorCode, errorMsg}})
 }
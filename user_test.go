@@ -1,8 +1,9 @@
 package main
 
 import (
-	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -11,50 +12,16 @@ import (
 	"testing"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
-
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 )
 
 const key = "fc58161e6b0da8e0cae8248f40141165"
 
-func setupMongodb(mongoDbHost string) (*mongo.Client, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+mongoDbHost))
-	defer cancel()
-
-	if err != nil {
-		return nil, err
-	}
-
-	// check if its connected
-	ctx, cancel = context.WithTimeout(context.Background(), 4*time.Second)
-	err = client.Ping(ctx, readpref.Primary())
-	defer cancel()
-
-	if err != nil {
-		return nil, err
-	}
-
-	return client, nil
-}
-
-func setup(db *mongo.Database) error {
+func setup(store Store) error {
 
 	//create a PC
-	pcData := bson.M{"key": key, "username": "username", "password": "passwd"}
-	collection := db.Collection("pcs")
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-
-	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-
-	collection.InsertOne(ctx, pcData)
+	store.InsertPC(&PCRecord{Key: key, Username: "username", Password: "passwd"})
 
 	userPermissions, err := ioutil.ReadFile("permissions.json")
 	if err != nil {
@@ -68,9 +35,12 @@ func setup(db *mongo.Database) error {
 		return err
 	}
 
-	userData["password"] = "passwd"
-	userData["pc_key"] = key
-	_, err = db.Collection("users").InsertOne(context.TODO(), userData)
+	err = store.InsertUser(&UserRecord{
+		Username:    userData["username"].(string),
+		Password:    "passwd",
+		PcKey:       key,
+		Permissions: userData["permissions"].(Json),
+	})
 	if err != nil {
 		log.Println(err.Error())
 	}
@@ -78,21 +48,21 @@ func setup(db *mongo.Database) error {
 	return nil
 }
 
-func teardown(db *mongo.Database) {
-	db.Drop(context.TODO())
+// assertUserCount waits for the server to register/remove the sessions of a PC
+func assertUserCount(t *testing.T, remotePc *RemotePC, count int) {
+	assert.Eventually(t, func() bool {
+		return len(remotePc.connectedUsers()) == count
+	}, time.Second, time.Millisecond*10)
 }
 
 func TestSuiteUser(t *testing.T) {
-	mongoClient, _ := setupMongodb("localhost:27017")
-	db := mongoClient.Database("test_remote_pc")
-
-	defer teardown(db)
+	store := NewMemoryStore()
 
-	if err := setup(db); err != nil {
+	if err := setup(store); err != nil {
 		panic(err.Error())
 	}
 
-	wsController := NewWsController("test", "test", "localhost:27017", "test_remote_pc")
+	wsController := NewWsController("test", "test", store, "")
 
 	server := httptest.NewServer(wsController.routes())
 	defer server.Close()
@@ -104,7 +74,7 @@ func TestSuiteUser(t *testing.T) {
 	// pcAuthHeader := http.Header{"X-Username": []string{"test"}, "X-Password": []string{"test"}}
 
 	//cria um PC remoto
-	wsPcConn, response, err := websocket.DefaultDialer.Dial(createRemotePcURL, authHeader)
+	wsPcConn, response, err := dialPC(createRemotePcURL, authHeader, nil)
 	assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
 	assert.Nil(t, err)
 
@@ -118,37 +88,48 @@ func TestSuiteUser(t *testing.T) {
 	})
 
 	t.Run("connectToPC", func(t *testing.T) {
-		ws, response, err := websocket.DefaultDialer.Dial(userConnectURL, authHeader)
+		ws, response, err := dialUser(userConnectURL, authHeader)
 
 		assert.Nil(t, err)
 		assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
 		assert.NotNil(t, ws)
 
-		assert.NotNil(t, wsController.remotePcs[key].user)
+		assertUserCount(t, wsController.remotePcs.get(key), 1)
 		assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
 		ws.Close()
+		time.Sleep(time.Millisecond * 100)
+	})
+
+	t.Run("plaintextPasswordsUpgraded", func(t *testing.T) {
+		pc, err := store.FindPC(key)
+		assert.Nil(t, err)
+		assert.True(t, isPasswordHash(pc.Password))
+
+		user, err := store.FindUser("username", key)
+		assert.Nil(t, err)
+		assert.True(t, isPasswordHash(user.Password))
 	})
 
 	/*
-		somente uma conexao por PC
-		qualquer tentativa de conexao deve falhar, enquanto tiver uma outra conexao ativa
+		varios usuarios podem acessar o mesmo PC, cada um com sua sessao
 	*/
-	t.Run("OneConnectionPerPc", func(t *testing.T) {
+	t.Run("ManyConnectionsPerPc", func(t *testing.T) {
 
 		//primeira conexao
-		ws, response, err := websocket.DefaultDialer.Dial(userConnectURL, authHeader)
+		ws, response, err := dialUser(userConnectURL, authHeader)
 		assert.Nil(t, err)
 		assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
-		assert.NotNil(t, wsController.remotePcs[key].user)
 
-		//segunda conexao -- deve falhar
-		newWsConn, response, err := websocket.DefaultDialer.Dial(userConnectURL, authHeader)
-		assert.Error(t, err)
-		assert.Nil(t, newWsConn)
-		assert.Equal(t, http.StatusBadRequest, response.StatusCode)
-		assert.NotNil(t, wsController.remotePcs[key].user)
+		//segunda conexao
+		newWsConn, response, err := dialUser(userConnectURL, authHeader)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+		assertUserCount(t, wsController.remotePcs.get(key), 2)
 
 		ws.Close()
+		newWsConn.Close()
+		time.Sleep(time.Millisecond * 100)
+		assert.Empty(t, wsController.remotePcs.get(key).connectedUsers())
 	})
 
 	/*
@@ -163,14 +144,14 @@ func TestSuiteUser(t *testing.T) {
 	})
 
 	t.Run("UserDisconnected", func(t *testing.T) {
-		ws, response, err := websocket.DefaultDialer.Dial(userConnectURL, authHeader)
+		ws, response, err := dialUser(userConnectURL, authHeader)
 		assert.Nil(t, err)
-		assert.NotNil(t, wsController.remotePcs[key].user)
+		assertUserCount(t, wsController.remotePcs.get(key), 1)
 		assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
 
 		ws.Close()
 		time.Sleep(time.Second * 1)
-		assert.Nil(t, wsController.remotePcs[key].user)
+		assert.Empty(t, wsController.remotePcs.get(key).connectedUsers())
 	})
 
 	// t.Run("userCantListFilesInDisallowedDir", func(t *testing.T) {
@@ -178,7 +159,7 @@ func TestSuiteUser(t *testing.T) {
 
 	// 	assert.Nil(t, err)
 	// 	assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
-	// 	assert.NotNil(t, wsController.remotePcs[key].user)
+	// 	assert.NotNil(t, wsController.remotePcs.get(key).user)
 
 	// 	commandRequest := Json{"type": "command", "cmd": "ls_dir", "args": []string{"/home/test"}, "stream": false}
 	// 	err = ws.WriteJSON(commandRequest)
@@ -201,3 +182,202 @@ func TestSuiteUser(t *testing.T) {
 	// })
 
 }
+
+func TestCreateUser(t *testing.T) {
+	store := NewMemoryStore()
+	store.InsertPC(&PCRecord{Key: key, Username: "username", Password: "passwd"})
+
+	tests := []struct {
+		username string
+		valid    bool
+	}{
+		{"alice", true},
+		{"alice.smith", true},
+		{"..alice", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../alice", false},
+		{"alice/..", false},
+		{`..\alice`, false},
+		{`alice\bob`, false},
+	}
+
+	for _, test := range tests {
+		regErr := CreateUser(Json{"username": test.username, "password": "passwd"}, key, store)
+		assert.Equal(t, test.valid, regErr.errorMsg == "", test.username)
+		if !test.valid {
+			assert.Equal(t, http.StatusBadRequest, regErr.httpStatusResponse, test.username)
+		}
+	}
+}
+
+func TestSessionRouting(t *testing.T) {
+	store := NewMemoryStore()
+	if err := setup(store); err != nil {
+		panic(err.Error())
+	}
+
+	wsController := NewWsController("test", "test", store, "")
+	server := httptest.NewServer(wsController.routes())
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	authHeader := http.Header{"X-Username": []string{"username"}, "X-Password": []string{"passwd"}}
+
+	wsPcConn, _, err := dialPC(wsURL+"/connect/"+key, authHeader, nil)
+	assert.Nil(t, err)
+	defer wsPcConn.Close()
+
+	// the PC learns the session of each user when they connect
+	connectUser := func() (*websocket.Conn, string) {
+		ws, _, err := dialUser(wsURL+"/access/"+key, authHeader)
+		assert.Nil(t, err)
+
+		info := make(Json)
+		assert.Nil(t, wsPcConn.ReadJSON(&info))
+		assert.Equal(t, float64(0xfc), info["code"])
+		return ws, info["session"].(string)
+	}
+
+	firstUser, firstSession := connectUser()
+	defer firstUser.Close()
+	secondUser, secondSession := connectUser()
+	defer secondUser.Close()
+	assert.NotEqual(t, firstSession, secondSession)
+
+	t.Run("MessagesToPcHaveSession", func(t *testing.T) {
+		assert.Nil(t, secondUser.WriteJSON(Json{"data": "hello"}))
+
+		msg := make(Json)
+		assert.Nil(t, wsPcConn.ReadJSON(&msg))
+		assert.Equal(t, secondSession, msg["session"])
+
+		assert.Nil(t, firstUser.WriteMessage(websocket.BinaryMessage, []byte("data")))
+		msgType, data, err := wsPcConn.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, websocket.BinaryMessage, msgType)
+		assert.Equal(t, sessionFrame(firstSession, []byte("data")), data)
+	})
+
+	t.Run("RepliesGoToTheirSession", func(t *testing.T) {
+		assert.Nil(t, wsPcConn.WriteJSON(Json{"session": firstSession, "data": "first"}))
+		assert.Nil(t, wsPcConn.WriteMessage(websocket.BinaryMessage, sessionFrame(secondSession, []byte("second"))))
+		assert.Nil(t, wsPcConn.WriteJSON(Json{"type": "info", "data": "everyone"}))
+
+		msg := make(Json)
+		assert.Nil(t, firstUser.ReadJSON(&msg))
+		assert.Equal(t, "first", msg["data"])
+		assert.Nil(t, firstUser.ReadJSON(&msg))
+		assert.Equal(t, "everyone", msg["data"])
+
+		_, data, err := secondUser.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, "second", string(data))
+		assert.Nil(t, secondUser.ReadJSON(&msg))
+		assert.Equal(t, "everyone", msg["data"])
+	})
+
+	t.Run("Observers", func(t *testing.T) {
+		observer, _, err := dialUser(wsURL+"/access/"+key+"?mode=observer", authHeader)
+		assert.Nil(t, err)
+		defer observer.Close()
+
+		info := make(Json)
+		assert.Nil(t, wsPcConn.ReadJSON(&info))
+		assert.Equal(t, float64(0xfb), info["code"])
+		assert.Len(t, info["data"], 1)
+
+		// observers get the replies sent to other sessions
+		assert.Nil(t, wsPcConn.WriteJSON(Json{"session": firstSession, "data": "first"}))
+		msg := make(Json)
+		assert.Nil(t, observer.ReadJSON(&msg))
+		assert.Equal(t, "first", msg["data"])
+		assert.Nil(t, firstUser.ReadJSON(&msg))
+
+		// and can't send anything
+		assert.Nil(t, observer.WriteJSON(Json{"type": "command", "cmd": "ls_dir", "args": []string{"/home/test"}}))
+		msg = make(Json)
+		assert.Nil(t, observer.ReadJSON(&msg))
+		assert.Equal(t, float64(PermissionDenied), msg["error_code"])
+
+		assert.Nil(t, observer.WriteJSON(Json{"data": "hello"}))
+		msg = make(Json)
+		assert.Nil(t, observer.ReadJSON(&msg))
+		assert.Equal(t, "Observer sessions are read-only", msg["error"])
+	})
+
+	t.Run("RepliesToClosedSessionsAreDropped", func(t *testing.T) {
+		// the observer of the last test left
+		info := make(Json)
+		assert.Nil(t, wsPcConn.ReadJSON(&info))
+		assert.Equal(t, float64(0xfb), info["code"])
+
+		thirdUser, thirdSession := connectUser()
+		thirdUser.Close()
+		for info := make(Json); info["code"] != float64(0x00); {
+			assert.Nil(t, wsPcConn.ReadJSON(&info))
+		}
+
+		assert.Nil(t, wsPcConn.WriteMessage(websocket.BinaryMessage, sessionFrame(thirdSession, []byte("file contents"))))
+		assert.Nil(t, wsPcConn.WriteMessage(websocket.BinaryMessage, []byte("no header")))
+		// broadcasts are told by their header, not by what they start with
+		event := append([]byte{binaryBroadcast}, thirdSession+" event"...)
+		assert.Nil(t, wsPcConn.WriteMessage(websocket.BinaryMessage, event))
+
+		for _, user := range []*websocket.Conn{firstUser, secondUser} {
+			_, data, err := user.ReadMessage()
+			assert.Nil(t, err)
+			assert.Equal(t, thirdSession+" event", string(data))
+		}
+	})
+
+	t.Run("ObserverOnlyUser", func(t *testing.T) {
+		adminHeader := http.Header{
+			"X-Username": []string{fmt.Sprintf("%x", sha256.Sum256([]byte("test")))},
+			"X-Password": []string{fmt.Sprintf("%x", sha256.Sum256([]byte("test")))},
+		}
+		connected, _, err := dialUser(wsURL+"/access/"+key+"?mode=observer", authHeader)
+		assert.Nil(t, err)
+		defer connected.Close()
+
+		resp, _ := postJson(t, server.URL+"/set_user_observer_only/"+key, adminHeader, Json{"username": "username", "observer_only": true})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// the control sessions already connected are closed, the observer stays
+		for _, user := range []*websocket.Conn{firstUser, secondUser} {
+			_, _, err := user.ReadMessage()
+			assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+		}
+		assert.Nil(t, wsPcConn.WriteJSON(Json{"type": "info", "data": "everyone"}))
+		msg := make(Json)
+		assert.Nil(t, connected.ReadJSON(&msg))
+		assert.Equal(t, "everyone", msg["data"])
+
+		_, response, err := dialUser(wsURL+"/access/"+key, authHeader)
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusForbidden, response.StatusCode)
+
+		observer, _, err := dialUser(wsURL+"/access/"+key+"?mode=observer", authHeader)
+		assert.Nil(t, err)
+		observer.Close()
+	})
+}
+
+// dialUser connects a user, reading the PC info every session gets first
+func dialUser(url string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	conn, response, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		return nil, response, err
+	}
+
+	info := make(Json)
+	if err = conn.ReadJSON(&info); err == nil && info["code"] != float64(0xf7) {
+		err = fmt.Errorf("expected the PC info: %v", info)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, response, err
+	}
+	return conn, response, nil
+}
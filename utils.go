@@ -35,3 +35,13 @@ func getAuthHeaders(req *http.Request) (string, string) {
 	password := strings.TrimSpace(req.Header.Get(http.CanonicalHeaderKey("x-password")))
 	return username, password
 }
+
+func httpError(response http.ResponseWriter, regErr RegisterError) {
+	jsonError, err := regErr.ToJsonString()
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	response.WriteHeader(regErr.httpStatusResponse)
+	response.Write(jsonError)
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"crypto/sha256"
 	"fmt"
 	"log"
@@ -11,10 +10,6 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 func ok(err error) bool { return err == nil }
@@ -22,54 +17,55 @@ func ok(err error) bool { return err == nil }
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true }}
+	CheckOrigin:     func(r *http.Request) bool { return true },
+	Subprotocols:    []string{tokenSubprotocol}}
 
 // WsController its just to keep track of connected PCs
 type WsController struct {
-	remotePcs        map[string]*RemotePC
-	adminUsername    string
-	adminPassword    string
-	disconnectPcChan chan string //will be used to remove/disconnect remote PCs
-	db               *mongo.Database
+	remotePcs     *pcRegistry
+	adminUsername string
+	adminPassword string
+	store         Store
+	tokens        *TokenIssuer
+	shutdown      chan struct{} // closed when the server starts shutting down
 }
 
-// NewWsController creates a new websocket controller
-func NewWsController(adminUsername, adminPassword, mongoDbHost, dbName string) *WsController {
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+mongoDbHost))
-	defer cancel()
-
+// NewWsController creates a new websocket controller, tokens are signed with tokenSecret (random if empty)
+func NewWsController(adminUsername, adminPassword string, store Store, tokenSecret string) *WsController {
+	tokens, err := NewTokenIssuer(tokenSecret)
 	if err != nil {
 		panic(err.Error())
 	}
 
-	// check if its connected
-	ctx, cancel = context.WithTimeout(context.Background(), 4*time.Second)
-	err = client.Ping(ctx, readpref.Primary())
-	defer cancel()
-
-	if err != nil {
-		panic("Failed to connect to mongodb host: " + mongoDbHost)
-	}
-
 	return &WsController{
-		make(map[string]*RemotePC),
+		newPcRegistry(),
 		fmt.Sprintf("%x", sha256.Sum256([]byte(adminUsername))),
 		fmt.Sprintf("%x", sha256.Sum256([]byte(adminPassword))),
-		make(chan string),
-		client.Database(dbName),
+		store,
+		tokens,
+		make(chan struct{}),
 	}
 }
 
 func (wsController *WsController) routes() *mux.Router {
 	router := mux.NewRouter()
 
-	router.HandleFunc("/create_pc/{key}", wsController.adminOnly(wsController.registerRemotePc()))              // create new PC
-	router.HandleFunc("/connect/{key}", wsController.newRemotePcConnection())                                   // PC connected
-	router.HandleFunc("/access/{key}", wsController.newUserConnection())                                        // user connect to a PC
-	router.HandleFunc("/create_user/{key}", wsController.adminOnly(wsController.createUser()))                  // create a new user
-	router.HandleFunc("/set_user_permissions/{key}", wsController.adminOnly(wsController.setUserPermissions())) // set user permissions
+	router.HandleFunc("/create_pc/{key}", wsController.adminOnly(wsController.registerRemotePc()))                     // create new PC
+	router.HandleFunc("/connect/{key}", wsController.newRemotePcConnection())                                          // PC connected
+	router.HandleFunc("/access/{key}", wsController.newUserConnection())                                               // user connect to a PC
+	router.HandleFunc("/create_user/{key}", wsController.adminOnly(wsController.createUser()))                         // create a new user
+	router.HandleFunc("/set_user_permissions/{key}", wsController.adminOnly(wsController.setUserPermissions()))        // set user permissions
+	router.HandleFunc("/set_user_observer_only/{key}", wsController.adminOnly(wsController.setUserObserverOnly()))     // only allow a user to observe
+	router.HandleFunc("/set_user_access/{key}", wsController.adminOnly(wsController.setUserAccess()))                  // when a user can connect
+	router.HandleFunc("/set_user_password/{key}", wsController.adminOnly(wsController.setUserPassword()))              // change a user password
+	router.HandleFunc("/check_permission/{key}", wsController.adminOnly(wsController.checkPermission()))               // would a user be allowed to run a command
+	router.HandleFunc("/set_user_roles/{key}", wsController.adminOnly(wsController.setUserRoles()))                    // assign roles to a user
+	router.HandleFunc("/create_role/{name}", wsController.globalAdminOnly(wsController.createRole()))                  // create a role with its permissions
+	router.HandleFunc("/set_role_permissions/{name}", wsController.globalAdminOnly(wsController.setRolePermissions())) // change a role, applied to connected users
+	router.HandleFunc("/remove_user/{key}", wsController.adminOnly(wsController.removeUser()))                         // remove a user
+	router.HandleFunc("/protocol", wsController.protocolInfo()).Methods("GET")                                         // protocol versions and code tables
+	router.HandleFunc("/login", wsController.login()).Methods("POST")                                                  // get access/refresh tokens
+	router.HandleFunc("/refresh", wsController.refresh()).Methods("POST")                                              // refresh an access token
 	return router
 }
 
@@ -86,7 +82,7 @@ func (wsController *WsController) registerRemotePc() http.HandlerFunc {
 			httpBadRequest(response)
 			return
 		}
-		regErr := CreateRemotePC(pcAuthData, wsController.db)
+		regErr := CreateRemotePC(pcAuthData, mux.Vars(req)["key"], wsController.store)
 		if regErr.httpStatusResponse != 0 {
 			log.Printf("Failed to create remote PC\nError: %s\n", regErr.Error())
 			jsonError, err := regErr.ToJsonString()
@@ -106,23 +102,46 @@ func (wsController *WsController) registerRemotePc() http.HandlerFunc {
 func (wsController *WsController) newRemotePcConnection() http.HandlerFunc {
 	return func(response http.ResponseWriter, req *http.Request) {
 		remotePcKey := mux.Vars(req)["key"]
-		username, password := getAuthHeaders(req)
 
-		if !AuthenticatePC(username, password, remotePcKey, wsController.db) {
-			response.WriteHeader(http.StatusForbidden)
+		if wsController.shuttingDown() {
+			response.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
 
-		// check if the key already exists
-		if _, found := wsController.remotePcs[remotePcKey]; !found {
+		if token := getAuthToken(req); len(token) > 0 {
+			if _, ok := wsController.checkToken(token, RolePC, remotePcKey); !ok {
+				response.WriteHeader(http.StatusForbidden)
+				return
+			}
+		} else {
+			username, password := getAuthHeaders(req)
+			if !AuthenticatePC(username, password, remotePcKey, wsController.store) {
+				response.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		// claim the key, so no other connection with it can be upgraded at the same time
+		if wsController.remotePcs.reserve(remotePcKey) {
 			wsConn, err := upgrader.Upgrade(response, req, nil)
 			if ok(err) {
 				remotePc := NewRemotePc(remotePcKey, wsConn, wsController)
-				wsController.remotePcs[remotePcKey] = remotePc
-				log.Printf("new remotePC %s\n", remotePcKey)
+				hello, err := readHello(wsConn)
+				if err != nil {
+					log.Printf("PC %s failed the handshake. Error: %s\n", remotePcKey, err.Error())
+					remotePc.writer.close(websocket.CloseProtocolError, err.Error())
+					wsController.remotePcs.release(remotePcKey)
+					return
+				}
+
+				remotePc.setHello(hello)
+				wsController.remotePcs.connected(remotePc)
+				sendInfo(remotePc, codeHelloAccepted, "Hello accepted", Json{"protocol_version": remotePc.version})
+				log.Printf("new remotePC %s (%s, %s, agent %s)\n", remotePcKey, hello.Hostname, hello.OS, hello.AgentVersion)
 				go remotePc.readRoutine()
 				return
 			}
+			wsController.remotePcs.release(remotePcKey)
 			log.Printf("Failed to upgrade websocket connection\nError: %s\n", err.Error())
 		}
 
@@ -137,34 +156,63 @@ func (wsController *WsController) newUserConnection() http.HandlerFunc {
 	return func(response http.ResponseWriter, req *http.Request) {
 		remotePcKey := mux.Vars(req)["key"]
 
-		username, password := getAuthHeaders(req)
+		if wsController.shuttingDown() {
+			response.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 
-		if len(username) == 0 || len(password) == 0 {
+		if !hasCredentials(req) {
 			response.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		if remotePc, found := wsController.remotePcs[remotePcKey]; found {
-			if remotePc.user != nil {
-				// PC already have a user connected
-				log.Printf("Remote PC %s already have a user connected", remotePcKey)
-				httpBadRequest(response)
+		if remotePc := wsController.remotePcs.get(remotePcKey); remotePc != nil {
+			userRecord := wsController.authenticateUserRequest(req, remotePcKey)
+
+			if userRecord == nil {
+				response.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			if reason := userRecord.Access.check(time.Now()); reason != "" {
+				log.Printf("User '%s' can't access PC %s: %s", userRecord.Username, remotePcKey, reason)
+				writeJson(response, http.StatusForbidden, Json{"error": reason})
+				return
+			}
+
+			version, err := parseProtocolVersion(req.URL.Query().Get("version"))
+			if err != nil {
+				writeJson(response, http.StatusBadRequest, Json{"error": err.Error()})
 				return
 			}
 
-			user := NewUser(username, password, remotePc, wsController.db)
+			observer := req.URL.Query().Get("mode") == "observer"
+			if userRecord.ObserverOnly && !observer {
+				log.Printf("User '%s' can only observe PC %s", userRecord.Username, remotePcKey)
+				response.WriteHeader(http.StatusForbidden)
+				return
+			}
 
+			user := NewUser(userRecord, remotePc, observer)
 			if user == nil {
-				response.WriteHeader(http.StatusUnauthorized)
+				response.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+			user.version = version
+			user.loadPermissions(userRecord, wsController.store)
 
 			wsConn, err := upgrader.Upgrade(response, req, nil)
 			if ok(err) {
-				user.wsConn = wsConn
-				remotePc.userConnected(user)
+				user.setConn(wsConn)
+				if err := remotePc.userConnected(user); err == errPcDisconnected {
+					// the PC disconnected while the user was connecting
+					user.writer.close(websocket.CloseGoingAway, "PC disconnected")
+					return
+				}
+				sendInfo(user, codePcInfo, "PC info", remotePc.hello)
+				user.watchAccess()
 				go user.readRoutine()
-				log.Printf("User connected to %s", remotePcKey)
+				log.Printf("User connected to %s (session %s)", remotePcKey, user.sessionId)
 				return
 			}
 
@@ -186,7 +234,7 @@ func (wsController *WsController) createUser() http.HandlerFunc {
 			return
 		}
 
-		regErr := CreateUser(userData, mux.Vars(req)["key"], wsController.db)
+		regErr := CreateUser(userData, mux.Vars(req)["key"], wsController.store)
 
 		if regErr.httpStatusResponse != 0 {
 			log.Printf("Failed to create user\nError: %s", regErr.Error())
@@ -204,17 +252,14 @@ func (wsController *WsController) createUser() http.HandlerFunc {
 	}
 }
 
-func (wsController *WsController) disconnectPCRoutine() {
-	defer close(wsController.disconnectPcChan)
-	for {
-		pcKey := <-wsController.disconnectPcChan
-
-		fmt.Printf("Disconnecting pc: %s\n", pcKey)
-		remotePc := wsController.remotePcs[pcKey]
-		remotePc.disconnectUser()
-
-		delete(wsController.remotePcs, pcKey)
+// disconnectPC removes the PC and closes the sessions of its users
+func (wsController *WsController) disconnectPC(remotePc *RemotePC) {
+	if !wsController.remotePcs.remove(remotePc) {
+		return
 	}
+
+	fmt.Printf("Disconnecting pc: %s\n", remotePc.key)
+	remotePc.disconnectUsers(websocket.CloseGoingAway, "PC disconnected")
 }
 
 func (wsController *WsController) setUserPermissions() http.HandlerFunc {
@@ -233,31 +278,277 @@ func (wsController *WsController) setUserPermissions() http.HandlerFunc {
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
+		username, okUsername := jsonData["username"].(string)
+		permissions, okPermissions := jsonData["permissions"].(Json)
 
-		user := wsController.db.Collection("users").FindOneAndUpdate(ctx,
-			bson.M{"username": jsonData["username"]},
-			bson.M{"$set": bson.M{"permissions": jsonData["permissions"]}})
+		if !okUsername || !okPermissions {
+			log.Printf("Invalid request - username must be a string and permissions an object")
+			httpBadRequest(response)
+			return
+		}
 
-		if user.Err() == nil {
+		if _, permErr := ParsePermissions(permissions); permErr != nil {
+			log.Printf("Invalid request - %s", permErr.Error())
+			writeJson(response, http.StatusBadRequest, Json{"error": "Invalid permissions", "fields": permErr})
+			return
+		}
+
+		pcKey := mux.Vars(req)["key"]
+		err = wsController.store.SetUserPermissions(username, pcKey, permissions)
+
+		if err == nil {
+			disconnect, _ := jsonData["force_disconnect"].(bool)
+			wsController.reloadPermissions(userSessions(username, pcKey), disconnect)
 			response.WriteHeader(http.StatusOK)
 			return
 		}
-		log.Printf("Failed to set user permissions. Error: %s\n", user.Err().Error())
+		log.Printf("Failed to set user permissions. Error: %s\n", err.Error())
 		response.WriteHeader(http.StatusBadRequest)
 	}
 }
 
+/*
+Handles a permission dry-run
+
+Checks a command for a user the same way it would be checked if sent by the user,
+returning the decision, the rule and restrictions that made it and the canonical args.
+Observer-only users and users outside of their access are denied, like their sessions would be
+*/
+func (wsController *WsController) checkPermission() http.HandlerFunc {
+	return func(response http.ResponseWriter, req *http.Request) {
+		jsonData, err := requestBodyToJson(req.Body)
+
+		if err != nil {
+			log.Printf("Error parsing json - %s", err.Error())
+			httpBadRequest(response)
+			return
+		}
+
+		username, okUsername := jsonData["username"].(string)
+		cmd, okCmd := jsonData["cmd"].(string)
+		requestArgs, okArgs := jsonData["args"].([]interface{})
+
+		if !okUsername || !okCmd || !okArgs {
+			log.Printf("Invalid request - username and cmd must be strings and args an array")
+			httpBadRequest(response)
+			return
+		}
+
+		userRecord, err := wsController.store.FindUser(username, mux.Vars(req)["key"])
+		if err == ErrNotFound {
+			writeJson(response, http.StatusNotFound, Json{"error": fmt.Sprintf("User '%s' not found", username)})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to find user. Error: %s\n", err.Error())
+			response.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		user := NewUser(userRecord, wsController.remotePcs.get(userRecord.PcKey), userRecord.ObserverOnly)
+		if user == nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// the OS of a PC that isn't connected can be given
+		if pcOs, ok := jsonData["os"].(string); ok {
+			if user.paths, err = parsePathFlavor(pcOs); err != nil {
+				writeJson(response, http.StatusBadRequest, Json{"error": err.Error()})
+				return
+			}
+		}
+		user.loadPermissions(userRecord, wsController.store)
+
+		decision := permissionDecision{Allow: false}
+		args, err := canonicalArgs(user.paths, cmd, requestArgs)
+		if err != nil {
+			decision.Reason = "Invalid arguments: " + err.Error()
+		} else {
+			decision = user.checkPermission(cmd, args)
+		}
+		if decision.Allow && user.remotePc != nil && !user.remotePc.supports(cmd) {
+			decision.Allow, decision.Reason = false, "Command not supported by the PC"
+		}
+		if reason := userRecord.Access.check(time.Now()); reason != "" {
+			decision.Allow, decision.Reason = false, reason
+		}
+
+		writeJson(response, http.StatusOK, struct {
+			permissionDecision
+			Args []interface{} `json:"args"`
+		}{decision, args})
+	}
+}
+
+// Handles observer-only access, users with it can only connect with ?mode=observer and their control sessions are closed
+func (wsController *WsController) setUserObserverOnly() http.HandlerFunc {
+	return func(response http.ResponseWriter, req *http.Request) {
+		jsonData, err := requestBodyToJson(req.Body)
+
+		if err != nil {
+			log.Printf("Error parsing json - %s", err.Error())
+			httpBadRequest(response)
+			return
+		}
+
+		username, okUsername := jsonData["username"].(string)
+		observerOnly, okObserverOnly := jsonData["observer_only"].(bool)
+
+		if !okUsername || !okObserverOnly {
+			log.Printf("Invalid request - missing username/observer_only keys in JSON")
+			httpBadRequest(response)
+			return
+		}
+
+		pcKey := mux.Vars(req)["key"]
+		err = wsController.store.SetUserObserverOnly(username, pcKey, observerOnly)
+		if err != nil {
+			log.Printf("Failed to set user observer only. Error: %s\n", err.Error())
+			response.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if observerOnly {
+			match := userSessions(username, pcKey)
+			wsController.closeSessions(func(user *User) bool {
+				return match(user) && !user.observer
+			}, "Observer only")
+		}
+
+		response.WriteHeader(http.StatusOK)
+	}
+}
+
+// Handles when a user can access the PC, sessions already connected follow the new access
+func (wsController *WsController) setUserAccess() http.HandlerFunc {
+	return func(response http.ResponseWriter, req *http.Request) {
+		jsonData, err := requestBodyToJson(req.Body)
+
+		if err != nil {
+			log.Printf("Error parsing json - %s", err.Error())
+			httpBadRequest(response)
+			return
+		}
+
+		username, okUsername := jsonData["username"].(string)
+		_, okAccess := jsonData["access"]
+
+		if !okUsername || !okAccess {
+			log.Printf("Invalid request - missing username/access keys in JSON")
+			httpBadRequest(response)
+			return
+		}
+
+		access, fieldErrs := ParseUserAccess(jsonData["access"])
+		if fieldErrs != nil {
+			writeJson(response, http.StatusBadRequest, Json{"error": "Invalid access", "fields": fieldErrs})
+			return
+		}
+
+		pcKey := mux.Vars(req)["key"]
+		err = wsController.store.SetUserAccess(username, pcKey, access)
+		if err != nil {
+			log.Printf("Failed to set user access. Error: %s\n", err.Error())
+			response.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		match := userSessions(username, pcKey)
+		for _, remotePc := range wsController.remotePcs.all() {
+			for _, user := range remotePc.connectedUsers() {
+				if match(user) {
+					user.setAccess(access.copy())
+				}
+			}
+		}
+
+		response.WriteHeader(http.StatusOK)
+	}
+}
+
+// Handles a password change, every token issued for the old password stops working and the sessions of the user are closed
+func (wsController *WsController) setUserPassword() http.HandlerFunc {
+	return func(response http.ResponseWriter, req *http.Request) {
+		jsonData, err := requestBodyToJson(req.Body)
+
+		if err != nil {
+			log.Printf("Error parsing json - %s", err.Error())
+			httpBadRequest(response)
+			return
+		}
+
+		username, _ := jsonData["username"].(string)
+		password, _ := jsonData["password"].(string)
+
+		if len(username) == 0 || len(password) == 0 {
+			log.Printf("Invalid request - missing username/password keys in JSON")
+			httpBadRequest(response)
+			return
+		}
+
+		passwordHash, err := hashPassword(password)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		pcKey := mux.Vars(req)["key"]
+		err = wsController.store.SetUserPassword(username, pcKey, passwordHash)
+		if err != nil {
+			log.Printf("Failed to set user password. Error: %s\n", err.Error())
+			response.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		wsController.closeSessions(userSessions(username, pcKey), "Password changed")
+
+		response.WriteHeader(http.StatusOK)
+	}
+}
+
+// Handles a user removal, every token issued for the user stops working and its sessions are closed
+func (wsController *WsController) removeUser() http.HandlerFunc {
+	return func(response http.ResponseWriter, req *http.Request) {
+		jsonData, err := requestBodyToJson(req.Body)
+
+		if err != nil {
+			log.Printf("Error parsing json - %s", err.Error())
+			httpBadRequest(response)
+			return
+		}
+
+		username, _ := jsonData["username"].(string)
+
+		pcKey := mux.Vars(req)["key"]
+		err = wsController.store.DeleteUser(username, pcKey)
+		if err != nil {
+			log.Printf("Failed to remove user. Error: %s\n", err.Error())
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+		wsController.closeSessions(userSessions(username, pcKey), "User removed")
+
+		response.WriteHeader(http.StatusOK)
+	}
+}
+
 func (wsController *WsController) adminOnly(handler http.HandlerFunc) http.HandlerFunc {
 	return func(response http.ResponseWriter, req *http.Request) {
 		remotePcKey := strings.TrimSpace(mux.Vars(req)["key"])
 
-		username, password := getAuthHeaders(req)
-		if len(username) == 0 ||
-			len(password) == 0 ||
-			len(remotePcKey) == 0 ||
-			(username != wsController.adminUsername && password != wsController.adminPassword) {
+		if len(remotePcKey) == 0 || !wsController.isAdminRequest(req, remotePcKey) {
+			response.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		handler(response, req)
+	}
+}
+
+// globalAdminOnly protects routes that are not about a single PC, like roles
+func (wsController *WsController) globalAdminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, req *http.Request) {
+		if !wsController.isAdminRequest(req, "") {
 			response.WriteHeader(http.StatusForbidden)
 			return
 		}
@@ -265,3 +556,14 @@ func (wsController *WsController) adminOnly(handler http.HandlerFunc) http.Handl
 		handler(response, req)
 	}
 }
+
+// isAdminRequest checks the admin credentials, or an admin token for the PC (for every PC if pcKey is empty)
+func (wsController *WsController) isAdminRequest(req *http.Request, pcKey string) bool {
+	if token := getAuthToken(req); len(token) > 0 {
+		_, ok := wsController.checkToken(token, RoleAdmin, pcKey)
+		return ok
+	}
+
+	username, password := getAuthHeaders(req)
+	return wsController.isAdmin(username, password)
+}